@@ -1,8 +1,12 @@
 package internal
 
 import (
-	"github.com/mannemsolutions/pgarrrow/pkg/pg"
+	"errors"
 	"time"
+
+	"github.com/mannemsolutions/pgarrrow/pkg/kafka"
+	"github.com/mannemsolutions/pgarrrow/pkg/pg"
+	"github.com/mannemsolutions/pgarrrow/pkg/rabbitmq"
 )
 
 func MainHandler() {
@@ -40,17 +44,38 @@ func HandlePgArrowKafka(config Config) (err error) {
 	defer pgConn.MustClose()
 	topic := config.KafkaConfig.NewTopic("stream")
 	defer topic.MustClose()
+	var ddlTopic *kafka.Topic
+	if config.PgConfig.DDLTopic {
+		ddlTopic = config.KafkaConfig.NewTopic("ddl")
+		defer ddlTopic.MustClose()
+	}
+	if config.PgConfig.InitialCopy {
+		copyTopic := config.KafkaConfig.NewTopic("copy")
+		defer copyTopic.MustClose()
+		pgConn.OnInitialCopy(func(t pg.Transaction) error {
+			raw, dErr := t.Dump()
+			if dErr != nil {
+				return dErr
+			}
+			return copyTopic.Publish(raw)
+		})
+	}
 	for {
 		if err = pgConn.StartRepl(); err != nil {
 			return err
 		}
 		t, pgErr := pgConn.NextTransactions()
-		if pgErr != nil {
+		if errors.Is(pgErr, pg.ErrConnectionLost) {
+			log.Errorf("%v", pgErr)
+			log.Infof("Reconnecting in 1 second")
 			if err = pgConn.Close(); err != nil {
 				return err
 			}
-			log.Debug(pgErr)
-			//return pgErr
+			time.Sleep(time.Second)
+			continue
+		} else if pgErr != nil {
+			// e.a. a change that is rejected by replica_identity_nothing, or that cannot be filtered or masked
+			return pgErr
 		}
 		if t.LSN == 0 {
 			log.Debugln("received 0 transaction. Skipping")
@@ -66,6 +91,17 @@ func HandlePgArrowKafka(config Config) (err error) {
 		if err = topic.Publish(raw); err != nil {
 			return err
 		}
+		if ddlTopic != nil {
+			// the ddl topic is an audit feed for external consumers, the stream topic holds the DDL as well
+			for _, ddl := range t.DDLChanges() {
+				if raw, dErr = ddl.Dump(); dErr != nil {
+					return dErr
+				} else if err = ddlTopic.Publish(raw); err != nil {
+					return err
+				}
+			}
+		}
+		pgConn.Confirm(t)
 	}
 }
 
@@ -74,10 +110,47 @@ func HandleKafkaArrowPg(config Config) (err error) {
 	pgConn := pg.NewConn(&config.PgConfig)
 	defer pgConn.MustClose()
 	log.Debug("Connecting to Kafka")
+	if config.PgConfig.DeadLetterTarget == "broker" {
+		deadTopic := config.KafkaConfig.NewTopic("dead")
+		defer deadTopic.MustClose()
+		pgConn.OnDeadLetter(deadTopic.Publish)
+	}
+	if config.PgConfig.InitialCopy {
+		if err = loadKafkaCopy(config, pgConn); err != nil {
+			return err
+		}
+	}
 	topic := config.KafkaConfig.NewTopic("stream")
 	defer topic.MustClose()
 
-	return topic.Process(pgConn.ProcessMsg)
+	return topic.ProcessBatch(config.PgConfig.ApplyBatchSize, config.PgConfig.ApplyBatchWait, pgConn.ProcessMsgs)
+}
+
+// loadKafkaCopy applies the copy topic until the initial copy is completely loaded
+func loadKafkaCopy(config Config, pgConn *pg.Conn) (err error) {
+	if finished, fErr := pgConn.CopyFinished(); fErr != nil {
+		return fErr
+	} else if finished {
+		log.Debug("Initial copy was already loaded")
+		return nil
+	}
+	log.Info("Loading initial copy")
+	copyTopic := config.KafkaConfig.NewTopic("copy")
+	defer copyTopic.MustClose()
+	err = copyTopic.Process(func(msg []byte) error {
+		if pErr := pgConn.ProcessMsg(msg); pErr != nil {
+			return pErr
+		} else if finished, fErr := pgConn.CopyFinished(); fErr != nil {
+			return fErr
+		} else if finished {
+			return kafka.ErrDone
+		}
+		return nil
+	})
+	if errors.Is(err, kafka.ErrDone) {
+		return nil
+	}
+	return err
 }
 
 func HandlePgArrowRabbit(config Config) (err error) {
@@ -86,17 +159,38 @@ func HandlePgArrowRabbit(config Config) (err error) {
 	defer pgConn.MustClose()
 	queue := config.RabbitMqConfig.NewQueue("stream")
 	defer queue.MustClose()
+	var ddlQueue *rabbitmq.Queue
+	if config.PgConfig.DDLTopic {
+		ddlQueue = config.RabbitMqConfig.NewQueue("ddl")
+		defer ddlQueue.MustClose()
+	}
+	if config.PgConfig.InitialCopy {
+		copyQueue := config.RabbitMqConfig.NewQueue("copy")
+		defer copyQueue.MustClose()
+		pgConn.OnInitialCopy(func(t pg.Transaction) error {
+			raw, dErr := t.Dump()
+			if dErr != nil {
+				return dErr
+			}
+			return rabbitPublish(copyQueue, raw)
+		})
+	}
 	for {
 		if err = pgConn.StartRepl(); err != nil {
 			return err
 		}
 		t, pgErr := pgConn.NextTransactions()
-		if pgErr != nil {
+		if errors.Is(pgErr, pg.ErrConnectionLost) {
+			log.Errorf("%v", pgErr)
+			log.Infof("Reconnecting in 1 second")
 			if err = pgConn.Close(); err != nil {
 				return err
 			}
-			log.Debug(pgErr)
-			//return pgErr
+			time.Sleep(time.Second)
+			continue
+		} else if pgErr != nil {
+			// e.a. a change that is rejected by replica_identity_nothing, or that cannot be filtered or masked
+			return pgErr
 		}
 		if t.LSN == 0 {
 			log.Debugln("received 0 transaction. Skipping")
@@ -109,30 +203,42 @@ func HandlePgArrowRabbit(config Config) (err error) {
 		if config.Debug {
 			log.Debugf("Transaction (%d bytes): %s", len(raw), string(raw))
 		}
-		rErr := func() error {
-			for {
-				if err = queue.CreateQueue(); err != nil {
-					log.Errorf("Unknown error: %v", err)
+		if err = rabbitPublish(queue, raw); err != nil {
+			return err
+		}
+		if ddlQueue != nil {
+			// the ddl queue is an audit feed for external consumers, the stream queue holds the DDL as well
+			for _, ddl := range t.DDLChanges() {
+				if raw, tErr = ddl.Dump(); tErr != nil {
+					return tErr
+				} else if err = rabbitPublish(ddlQueue, raw); err != nil {
 					return err
 				}
-				log.Debug("Queue created")
-				if err = queue.Publish(raw); err != nil {
-					log.Errorf("Error while publishing data")
-					log.Infof("Retrying in 10 seconds")
-					time.Sleep(10 * time.Second)
-					if err = queue.Close(); err != nil {
-						log.Errorf("Closing channel")
-						return err
-					}
-					queue = config.RabbitMqConfig.NewQueue("stream")
-				} else {
-					log.Debug("Data published")
-					return nil
-				}
 			}
-		}()
-		if rErr != nil {
-			return rErr
+		}
+		pgConn.Confirm(t)
+	}
+}
+
+// rabbitPublish publishes to a queue, and retries (with a new connection) when publishing fails
+func rabbitPublish(queue *rabbitmq.Queue, raw []byte) (err error) {
+	for {
+		if err = queue.CreateQueue(); err != nil {
+			log.Errorf("Unknown error: %v", err)
+			return err
+		}
+		log.Debug("Queue created")
+		if err = queue.Publish(raw); err != nil {
+			log.Errorf("Error while publishing data")
+			log.Infof("Retrying in 10 seconds")
+			time.Sleep(10 * time.Second)
+			if err = queue.Close(); err != nil {
+				log.Errorf("Closing channel")
+				return err
+			}
+		} else {
+			log.Debug("Data published")
+			return nil
 		}
 	}
 }
@@ -142,10 +248,27 @@ func HandleRabbitArrowPg(config Config) (err error) {
 	pgConn := pg.NewConn(&config.PgConfig)
 	defer pgConn.MustClose()
 	log.Debug("Connecting to RabbitMQ")
+	if config.PgConfig.DeadLetterTarget == "broker" {
+		deadQueue := config.RabbitMqConfig.NewQueue("dead")
+		defer deadQueue.MustClose()
+		pgConn.OnDeadLetter(func(raw []byte) error {
+			return rabbitPublish(deadQueue, raw)
+		})
+	}
+	if config.PgConfig.InitialCopy {
+		if err = loadRabbitCopy(config, pgConn); err != nil {
+			return err
+		}
+	}
 	queue := config.RabbitMqConfig.NewQueue("stream")
 	defer queue.MustClose()
 	for {
-		if err = queue.Process(pgConn.ProcessMsg); err != nil {
+		err = queue.ProcessBatch(config.PgConfig.ApplyBatchSize, config.PgConfig.ApplyBatchWait, pgConn.ProcessMsgs)
+		if errors.Is(err, rabbitmq.ErrUnavailable) {
+			log.Errorf("%v", err)
+			log.Infof("Retrying in 10 seconds")
+			time.Sleep(10 * time.Second)
+		} else if err != nil {
 			return err
 		}
 		if err = queue.Close(); err != nil {
@@ -153,3 +276,40 @@ func HandleRabbitArrowPg(config Config) (err error) {
 		}
 	}
 }
+
+// loadRabbitCopy applies the copy queue until the initial copy is completely loaded
+func loadRabbitCopy(config Config, pgConn *pg.Conn) (err error) {
+	if finished, fErr := pgConn.CopyFinished(); fErr != nil {
+		return fErr
+	} else if finished {
+		log.Debug("Initial copy was already loaded")
+		return nil
+	}
+	log.Info("Loading initial copy")
+	copyQueue := config.RabbitMqConfig.NewQueue("copy")
+	defer copyQueue.MustClose()
+	for {
+		err = copyQueue.Process(func(msg []byte) error {
+			if pErr := pgConn.ProcessMsg(msg); pErr != nil {
+				return pErr
+			} else if finished, fErr := pgConn.CopyFinished(); fErr != nil {
+				return fErr
+			} else if finished {
+				return rabbitmq.ErrDone
+			}
+			return nil
+		})
+		if errors.Is(err, rabbitmq.ErrDone) {
+			return nil
+		} else if errors.Is(err, rabbitmq.ErrUnavailable) {
+			log.Errorf("%v", err)
+			log.Infof("Retrying in 10 seconds")
+			time.Sleep(10 * time.Second)
+		} else if err != nil {
+			return err
+		}
+		if err = copyQueue.Close(); err != nil {
+			return err
+		}
+	}
+}
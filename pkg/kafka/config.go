@@ -9,6 +9,7 @@ import (
 )
 
 type Config struct {
+	BatchTimeout  time.Duration `yaml:"batch_timeout"`
 	Brokers       []string      `yaml:"brokers"`
 	Deadline      time.Duration `yaml:"deadline"`
 	MaxBatchBytes int           `yaml:"max_batch_bytes"`
@@ -23,6 +24,10 @@ func (c *Config) Initialize() (err error) {
 	if c.Deadline.Milliseconds() < 1 {
 		c.Deadline = time.Second
 	}
+	if c.BatchTimeout <= 0 {
+		// writes are synchronous, so this limits how long a Publish waits for more messages to fill a batch
+		c.BatchTimeout = 5 * time.Millisecond
+	}
 	if c.MinBatchBytes < 1 {
 		// 1MB (maybe derive sane defaults for performance tests?)
 		c.MinBatchBytes = 96
@@ -1,12 +1,16 @@
 package kafka
 
 import (
+	"context"
 	"errors"
 	"github.com/segmentio/kafka-go"
 	"net"
 	"time"
 )
 
+// ErrDone can be returned by a PostProcessor to stop Process after the message is committed
+var ErrDone = errors.New("done processing messages")
+
 type Topics map[string]*Topic
 
 type Topic struct {
@@ -38,11 +42,15 @@ func (t *Topic) ConnectWriter() {
 	if t.writer != nil {
 		return
 	}
+	// Writes are synchronous and acknowledged by all in-sync replicas,
+	// so that a successful Publish can be used to advance the replication slot.
+	// A Publish writes its messages as one batch, so the batch timeout only needs to be short.
 	t.writer = &kafka.Writer{
-		Addr:       kafka.TCP(t.config.Brokers...),
-		Topic:      t.name,
-		BatchBytes: int64(t.config.MaxBatchBytes),
-		Async:      true,
+		Addr:         kafka.TCP(t.config.Brokers...),
+		Topic:        t.name,
+		BatchBytes:   int64(t.config.MaxBatchBytes),
+		BatchTimeout: t.config.BatchTimeout,
+		RequiredAcks: kafka.RequireAll,
 	}
 }
 
@@ -155,6 +163,21 @@ func processErrorUnWrapper(err error) error {
 	}
 }
 
+// fetchError logs an error of FetchMessage, and returns nil for errors that can be retried
+func fetchError(err error) error {
+	err = processErrorUnWrapper(err)
+	switch err.(type) {
+	case *net.OpError:
+		log.Errorf("Kafka not available: %v", err)
+	case kafka.Error:
+		log.Errorf("Kafka error: %v", err)
+	default:
+		log.Errorf("I don't understand this error: (%T) -> %v", err, err)
+		return err
+	}
+	return nil
+}
+
 func (t Topic) Process(PostProcessor func([]byte) error) (err error) {
 	if err = t.ConnectReader(); err != nil {
 		return err
@@ -165,21 +188,64 @@ func (t Topic) Process(PostProcessor func([]byte) error) (err error) {
 		//tCtx, tCtxCancel := t.parent.Context()
 		//defer tCtxCancel()
 		if msg, err = t.reader.FetchMessage(ctx); err != nil {
-			err = processErrorUnWrapper(err)
-			switch err.(type) {
-			case *net.OpError:
-				log.Errorf("Kafka not available: %v", err)
-			case kafka.Error:
-				log.Errorf("Kafka error: %v", err)
-			default:
-				log.Errorf("I don't understand this error: (%T) -> %v", err, err)
+			if err = fetchError(err); err != nil {
+				return err
+			}
+		} else if err = PostProcessor(msg.Value); err != nil && !errors.Is(err, ErrDone) {
+			log.Debugf("PostProcessor error: %e", err)
+			return err
+		} else if cErr := t.reader.CommitMessages(ctx, msg); cErr != nil {
+			log.Debugf("CommitMessages error: %e", cErr)
+			return cErr
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// ProcessBatch fetches up to batchSize messages (waiting at most maxWait after the first message of a batch),
+// processes them with one call of PostProcessor, and commits the offsets of all of them when PostProcessor succeeded
+func (t Topic) ProcessBatch(batchSize int, maxWait time.Duration, PostProcessor func([][]byte) error) (err error) {
+	if batchSize <= 1 {
+		return t.Process(func(msg []byte) error {
+			return PostProcessor([][]byte{msg})
+		})
+	}
+	if err = t.ConnectReader(); err != nil {
+		return err
+	}
+	for {
+		msg, fErr := t.reader.FetchMessage(ctx)
+		if fErr != nil {
+			if err = fetchError(fErr); err != nil {
 				return err
 			}
-		} else if err = PostProcessor(msg.Value); err != nil {
+			continue
+		}
+		msgs := []kafka.Message{msg}
+		deadline := time.Now().Add(maxWait)
+		for len(msgs) < batchSize {
+			wCtx, wCtxCancel := context.WithDeadline(ctx, deadline)
+			msg, fErr = t.reader.FetchMessage(wCtx)
+			wCtxCancel()
+			if fErr != nil {
+				// the batch is processed, and errors (other than the deadline) show up with the next fetch
+				break
+			}
+			msgs = append(msgs, msg)
+		}
+		var values [][]byte
+		for _, m := range msgs {
+			values = append(values, m.Value)
+		}
+		log.Debugf("processing a batch of %d messages", len(msgs))
+		if err = PostProcessor(values); err != nil && !errors.Is(err, ErrDone) {
 			log.Debugf("PostProcessor error: %e", err)
 			return err
-		} else if err = t.reader.CommitMessages(ctx, msg); err != nil {
-			log.Debugf("CommitMessages error: %e", err)
+		} else if cErr := t.reader.CommitMessages(ctx, msgs...); cErr != nil {
+			log.Debugf("CommitMessages error: %e", cErr)
+			return cErr
+		} else if err != nil {
 			return err
 		}
 	}
@@ -17,10 +17,12 @@ type Column struct {
 	Meta MetaData
 }
 
+// Data holds the value of a column. Unchanged TOAST values (Type 'u') have no data, and are marked as Unchanged.
 type Data struct {
-	Type   uint8
-	Length uint32
-	Data   []byte
+	Type      uint8
+	Length    uint32
+	Data      []byte
+	Unchanged bool `json:",omitempty"`
 }
 
 type MetaData struct {
@@ -32,7 +34,7 @@ type MetaData struct {
 }
 
 func (d Data) Changed() bool {
-	return d.Type != 'u'
+	return d.Type != 'u' && !d.Unchanged
 }
 
 func tryValuerToString(v driver.Valuer) (string, error) {
@@ -98,8 +100,14 @@ func (c Column) Sql() string {
 				log.Fatalf("pgarrow does not work (yet) with (pg=>%s,go=>%T) values", c.Meta.TypeName, v)
 			}
 		}
+	case 'b': // binary
+		text, err := binaryToText(c.Data.Data, c.Meta.TypeOID, c.Meta.TypeName)
+		if err != nil {
+			log.Fatalf("error decoding binary %s column data: %v", c.Meta.TypeName, err)
+		}
+		return fmt.Sprintf("%s::%s", stringValueSql(text), c.Meta.TypeName)
 	default:
-		log.Fatalf("column data has unexpected datatype %c (instead of 'n', 'u', or 't')", c.Data.Type)
+		log.Fatalf("column data has unexpected datatype %c (instead of 'n', 'u', 't' or 'b')", c.Data.Type)
 	}
 	log.Fatalf("I did not expect to get to the end of Column{%v}.String().", c)
 	return ""
@@ -117,7 +125,9 @@ func ColValsFromLogMsg(cols []*pglogrepl.TupleDataColumn, relInfo *pglogrepl.Rel
 				Data: Data{
 					Type:   col.DataType,
 					Length: col.Length,
-					Data:   col.Data,
+					// copy, since the receive buffer is reused for the next message
+					Data:      append([]byte(nil), col.Data...),
+					Unchanged: col.DataType == 'u',
 				},
 				Meta: MetaData{
 					Flags:    meta.Flags,
@@ -132,11 +142,27 @@ func ColValsFromLogMsg(cols []*pglogrepl.TupleDataColumn, relInfo *pglogrepl.Rel
 	return cvs
 }
 
-func WhereFromLogMsg(cols []*pglogrepl.RelationMessageColumn, newVals Columns) Columns {
+// WhereFromLogMsg returns the columns that identify a row, depending on the replica identity of the relation.
+// oldVals is nil when the source did not send the old tuple (an UPDATE that did not change the key).
+// For replica identity nothing (or default without a primary key) no columns are returned.
+func WhereFromLogMsg(relInfo *pglogrepl.RelationMessage, oldVals Columns, newVals Columns) Columns {
 	where := make(Columns)
-	for _, col := range cols {
-		if col.Flags == 1 {
-			where[col.Name] = newVals[col.Name]
+	switch relInfo.ReplicaIdentity {
+	case 'f': // full: all columns of the old row
+		for name, col := range oldVals {
+			if col.Data.Changed() {
+				where[name] = col
+			}
+		}
+	case 'd', 'i': // default (primary key) or using index: the key columns of the old row, or of the new row
+		vals := oldVals
+		if vals == nil {
+			vals = newVals
+		}
+		for _, col := range relInfo.Columns {
+			if value, ok := vals[col.Name]; ok && col.Flags == 1 && value.Data.Changed() {
+				where[col.Name] = value
+			}
 		}
 	}
 	return where
@@ -155,28 +181,38 @@ func (cvs Columns) ColNamesValues() (names []string, values []string) {
 	return names, values
 }
 
-func (cvs Columns) colIsValues() []string {
+func (cvs Columns) colIsValues(operator string) []string {
 	var parts []string
 	for key, value := range cvs {
+		if !value.Data.Changed() {
+			// unchanged TOAST values are not sent by the source, the destination already has them
+			continue
+		}
 		// Values should already be parsed into this topic as valid SQL, like NULL, 0, 1.234 or 'whatever text with '' quotes'
 		// repackValueSql is there to make sure we don't allow for SQL Injection, by
 		// allowing for  values like NULL, 0, 1.234, etc. And repacking text (unquoting and re-quoting)...
-		part := fmt.Sprintf("%s = %s", identifierNameSql(key), value.Sql())
+		part := fmt.Sprintf("%s %s %s", identifierNameSql(key), operator, value.Sql())
 		parts = append(parts, part)
 	}
 	return parts
 }
 
 func (cvs Columns) SetSQL() string {
-	parts := cvs.colIsValues()
+	parts := cvs.colIsValues("=")
 	if len(parts) == 0 {
 		log.Fatal("Seems we are about to run an update query with an empty SET statement!!!")
 	}
 	return strings.Join(parts, ", ")
 }
 
-func (cvs Columns) WhereSQL() string {
-	parts := cvs.colIsValues()
+// WhereSQL returns the where clause for these columns.
+// With nullSafe (replica identity full) columns are compared with IS NOT DISTINCT FROM, so that NULL values match.
+func (cvs Columns) WhereSQL(nullSafe bool) string {
+	operator := "="
+	if nullSafe {
+		operator = "IS NOT DISTINCT FROM"
+	}
+	parts := cvs.colIsValues(operator)
 	if len(parts) == 0 {
 		log.Fatal("Seems we are about to run a query without WHERE statement!!!")
 	}
@@ -0,0 +1,55 @@
+package pg
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+func TestWhereFromLogMsg(t *testing.T) {
+	relation := func(identity uint8, keys ...string) *pglogrepl.RelationMessage {
+		rel := &pglogrepl.RelationMessage{Namespace: "public", RelationName: "orders", ReplicaIdentity: identity}
+		for _, name := range []string{"id", "region", "note"} {
+			col := &pglogrepl.RelationMessageColumn{Name: name}
+			for _, key := range keys {
+				if key == name {
+					col.Flags = 1
+				}
+			}
+			rel.Columns = append(rel.Columns, col)
+		}
+		return rel
+	}
+	oldVals := textColumns(map[string]*string{"id": strPtr("1"), "region": strPtr("EU"), "note": strPtr("old")})
+	oldVals["note"] = Column{Meta: MetaData{Name: "note"}, Data: Data{Type: 'u'}}
+	newVals := textColumns(map[string]*string{"id": strPtr("2"), "region": strPtr("US"), "note": strPtr("new")})
+	for _, test := range []struct {
+		name     string
+		rel      *pglogrepl.RelationMessage
+		oldVals  Columns
+		expected map[string]string
+	}{
+		{"default with old row", relation('d', "id"), oldVals, map[string]string{"id": "1"}},
+		{"default without old row", relation('d', "id"), nil, map[string]string{"id": "2"}},
+		{"index with old row", relation('i', "id", "region"), oldVals, map[string]string{"id": "1", "region": "EU"}},
+		{"index without old row", relation('i', "id", "region"), nil, map[string]string{"id": "2", "region": "US"}},
+		// unchanged TOAST values of the old row cannot be used in the where clause
+		{"full", relation('f', "id", "region", "note"), oldVals, map[string]string{"id": "1", "region": "EU"}},
+		{"default without primary key", relation('d'), oldVals, map[string]string{}},
+		{"nothing", relation('n'), oldVals, map[string]string{}},
+	} {
+		where := WhereFromLogMsg(test.rel, test.oldVals, newVals)
+		var names []string
+		for name, col := range where {
+			names = append(names, name)
+			if value := string(col.Data.Data); value != test.expected[name] {
+				t.Errorf("%s: expected %s = %q, got %q", test.name, name, test.expected[name], value)
+			}
+		}
+		if len(where) != len(test.expected) {
+			sort.Strings(names)
+			t.Errorf("%s: expected columns %v, got %v", test.name, test.expected, names)
+		}
+	}
+}
@@ -1,12 +1,65 @@
 package pg
 
-import "time"
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	DSN                   Dsn               `yaml:"dsn"`
 	Slot                  string            `yaml:"slot_name"`
 	SkipErrors            map[string]string `yaml:"skip_errors"`
 	StandbyMessageTimeout time.Duration     `yaml:"standby_message_timeout"`
+	Publications          []string          `yaml:"publications"`
+	ProtoVersion          int               `yaml:"proto_version"`
+	Messages              bool              `yaml:"messages"`
+	Binary                bool              `yaml:"binary"`
+	Origin                string            `yaml:"origin"`
+	ApplyOrigin           string            `yaml:"replication_origin"`
+	Streaming             bool              `yaml:"streaming"`
+	TwoPhase              bool              `yaml:"two_phase"`
+	StateFile             string            `yaml:"state_file"`
+	AcceptFailover        bool              `yaml:"accept_failover"`
+	InitialCopy           bool              `yaml:"initial_copy"`
+	CopyBatchSize         int               `yaml:"copy_batch_size"`
+	CopyTable             string            `yaml:"copy_table"`
+	DDLCapture            bool              `yaml:"ddl_capture"`
+	DDLAllowlist          []string          `yaml:"ddl_allowlist"`
+	DDLTopic              bool              `yaml:"ddl_topic"`
+	CreateTables          bool              `yaml:"create_tables"`
+	IdentityNothing       string            `yaml:"replica_identity_nothing"`
+	FetchToast            bool              `yaml:"fetch_toast"`
+	IncludeTables         []string          `yaml:"include_tables"`
+	ExcludeTables         []string          `yaml:"exclude_tables"`
+	RowFilters            map[string]string `yaml:"row_filters"`
+	Columns               TableColumns      `yaml:"columns"`
+	MaskKey               string            `yaml:"mask_key"`
+	SchemaMap             map[string]string `yaml:"schema_map"`
+	TableMap              map[string]string `yaml:"table_map"`
+	ColumnMap             ColumnMaps        `yaml:"column_map"`
+	SourceID              string            `yaml:"source_id"`
+	SourceColumn          string            `yaml:"source_column"`
+	ConflictPolicy        string            `yaml:"conflict_policy"`
+	ConflictPolicies      map[string]string `yaml:"conflict_policies"`
+	ConflictTable         string            `yaml:"conflict_table"`
+	ProgressTable         string            `yaml:"progress_table"`
+	FailurePolicy         string            `yaml:"failure_policy"`
+	FailurePolicies       map[string]string `yaml:"failure_policies"`
+	DeadLetterTarget      string            `yaml:"dead_letter_target"`
+	DeadLetterTable       string            `yaml:"dead_letter_table"`
+	Retry                 RetryPolicies     `yaml:"retry"`
+	Pipeline              string            `yaml:"pipeline"`
+	ApplyBatchSize        int               `yaml:"apply_batch_size"`
+	ApplyBatchWait        time.Duration     `yaml:"apply_batch_wait"`
+	ApplyWorkers          int               `yaml:"apply_workers"`
+	StreamTable           string            `yaml:"stream_table"`
+	MessageTable          string            `yaml:"message_table"`
+	MessagePrefixes       []string          `yaml:"message_prefixes"`
+	rowFilters            map[string]rowFilter
+	columnMasks           map[string]map[string]maskRule
+	tableMappings         []tableMapping
 }
 
 // Initialize currently has no function, but can be used to initialize teh config with defaults
@@ -20,6 +73,121 @@ func (c *Config) Initialize() (err error) {
 	if c.StandbyMessageTimeout.Milliseconds() < 1 {
 		c.StandbyMessageTimeout = time.Second * 10
 	}
+	if len(c.Publications) == 0 {
+		c.Publications = []string{"pgarrow"}
+	}
+	if c.ProtoVersion < 1 {
+		c.ProtoVersion = 1
+	}
+	if c.StreamTable == "" {
+		c.StreamTable = "pgarrow_stream"
+	}
+	if c.CopyBatchSize < 1 {
+		c.CopyBatchSize = 1000
+	}
+	if c.CopyTable == "" {
+		c.CopyTable = "pgarrow_copy"
+	}
+	if c.IdentityNothing == "" {
+		c.IdentityNothing = "reject"
+	}
+	switch c.IdentityNothing {
+	case "reject", "skip":
+	default:
+		return fmt.Errorf("invalid value for replica_identity_nothing (%s), should be `reject` or `skip`",
+			c.IdentityNothing)
+	}
+	for _, pattern := range append(append([]string{}, c.IncludeTables...), c.ExcludeTables...) {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid table pattern %s: %w", pattern, err)
+		}
+	}
+	c.rowFilters = make(map[string]rowFilter)
+	for table, predicate := range c.RowFilters {
+		if c.rowFilters[table], err = parseRowFilter(predicate); err != nil {
+			return err
+		}
+	}
+	c.columnMasks = make(map[string]map[string]maskRule)
+	for table, rules := range c.Columns {
+		c.columnMasks[table] = make(map[string]maskRule)
+		for column, rule := range rules.Mask {
+			if c.columnMasks[table][column], err = parseMaskRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+	if c.tableMappings, err = parseTableMappings(c.TableMap); err != nil {
+		return err
+	}
+	if c.ApplyBatchSize < 1 {
+		c.ApplyBatchSize = 1
+	}
+	if c.ApplyBatchWait.Milliseconds() < 1 {
+		c.ApplyBatchWait = 100 * time.Millisecond
+	}
+	if c.ApplyWorkers < 1 {
+		c.ApplyWorkers = 1
+	} else if c.ApplyWorkers > 1 && c.ApplyBatchSize == 1 {
+		return fmt.Errorf("apply_workers %d requires an apply_batch_size larger than 1, since only the messages of "+
+			"a batch are applied in parallel", c.ApplyWorkers)
+	}
+	if c.ProgressTable == "" {
+		c.ProgressTable = "pgarrow_progress"
+	}
+	if c.Pipeline == "" {
+		c.Pipeline = c.Slot
+	}
+	if c.FailurePolicy == "" {
+		c.FailurePolicy = "stop"
+	}
+	for table, policy := range c.FailurePolicies {
+		if _, ok := FailurePolicies[policy]; !ok {
+			return fmt.Errorf("invalid failure policy %s for %s", policy, table)
+		}
+	}
+	if _, ok := FailurePolicies[c.FailurePolicy]; !ok {
+		return fmt.Errorf("invalid value for failure_policy (%s), should be `stop`, `dead_letter` or `skip`",
+			c.FailurePolicy)
+	}
+	if c.DeadLetterTarget == "" {
+		c.DeadLetterTarget = "table"
+	}
+	switch c.DeadLetterTarget {
+	case "table", "broker":
+	default:
+		return fmt.Errorf("invalid value for dead_letter_target (%s), should be `table` or `broker`",
+			c.DeadLetterTarget)
+	}
+	if c.DeadLetterTable == "" {
+		c.DeadLetterTable = "pgarrow_dead_letter"
+	}
+	if c.Retry == nil {
+		c.Retry = make(RetryPolicies)
+	}
+	if err = c.Retry.initialize(); err != nil {
+		return err
+	}
+	if c.ConflictTable == "" {
+		c.ConflictTable = "pgarrow_conflict"
+	}
+	if c.ConflictPolicy == "" {
+		c.ConflictPolicy = "error"
+	}
+	for table, policy := range c.ConflictPolicies {
+		if !ConflictPolicies[policy] {
+			return fmt.Errorf("invalid conflict policy %s for %s", policy, table)
+		}
+	}
+	if !ConflictPolicies[c.ConflictPolicy] {
+		return fmt.Errorf("invalid value for conflict_policy (%s), should be `error`, `upsert`, `keep_local`, "+
+			"`last_writer_wins` or `conflict_table`", c.ConflictPolicy)
+	}
+	switch c.Origin {
+	case "", "none", "any":
+	default:
+		return fmt.Errorf("invalid value for origin (%s), should be `none` or `any`", c.Origin)
+	}
 	return nil
 }
 
@@ -28,9 +196,116 @@ func (c Config) Clone() (newConfig Config) {
 		DSN:                   c.DSN.Clone(),
 		Slot:                  c.Slot,
 		StandbyMessageTimeout: c.StandbyMessageTimeout,
+		Publications:          append([]string{}, c.Publications...),
+		ProtoVersion:          c.ProtoVersion,
+		Messages:              c.Messages,
+		Binary:                c.Binary,
+		Origin:                c.Origin,
+		ApplyOrigin:           c.ApplyOrigin,
+		Streaming:             c.Streaming,
+		TwoPhase:              c.TwoPhase,
+		StateFile:             c.StateFile,
+		AcceptFailover:        c.AcceptFailover,
+		InitialCopy:           c.InitialCopy,
+		CopyBatchSize:         c.CopyBatchSize,
+		CopyTable:             c.CopyTable,
+		DDLCapture:            c.DDLCapture,
+		DDLAllowlist:          append([]string{}, c.DDLAllowlist...),
+		DDLTopic:              c.DDLTopic,
+		CreateTables:          c.CreateTables,
+		IdentityNothing:       c.IdentityNothing,
+		FetchToast:            c.FetchToast,
+		IncludeTables:         append([]string{}, c.IncludeTables...),
+		ExcludeTables:         append([]string{}, c.ExcludeTables...),
+		RowFilters:            make(map[string]string),
+		Columns:               make(TableColumns),
+		MaskKey:               c.MaskKey,
+		SchemaMap:             make(map[string]string),
+		TableMap:              make(map[string]string),
+		ColumnMap:             c.ColumnMap.Clone(),
+		SourceID:              c.SourceID,
+		SourceColumn:          c.SourceColumn,
+		ConflictPolicy:        c.ConflictPolicy,
+		ConflictPolicies:      make(map[string]string),
+		ConflictTable:         c.ConflictTable,
+		ProgressTable:         c.ProgressTable,
+		FailurePolicy:         c.FailurePolicy,
+		FailurePolicies:       make(map[string]string),
+		DeadLetterTarget:      c.DeadLetterTarget,
+		DeadLetterTable:       c.DeadLetterTable,
+		Retry:                 c.Retry.Clone(),
+		Pipeline:              c.Pipeline,
+		ApplyBatchSize:        c.ApplyBatchSize,
+		ApplyBatchWait:        c.ApplyBatchWait,
+		ApplyWorkers:          c.ApplyWorkers,
+		StreamTable:           c.StreamTable,
+		MessageTable:          c.MessageTable,
+		MessagePrefixes:       append([]string{}, c.MessagePrefixes...),
+	}
+	for table, predicate := range c.RowFilters {
+		newConfig.RowFilters[table] = predicate
+	}
+	for table, rules := range c.Columns {
+		newConfig.Columns[table] = rules.Clone()
+	}
+	for schema, destination := range c.SchemaMap {
+		newConfig.SchemaMap[schema] = destination
+	}
+	for table, destination := range c.TableMap {
+		newConfig.TableMap[table] = destination
+	}
+	for table, policy := range c.FailurePolicies {
+		newConfig.FailurePolicies[table] = policy
+	}
+	for table, policy := range c.ConflictPolicies {
+		newConfig.ConflictPolicies[table] = policy
 	}
 	if err := newConfig.Initialize(); err != nil {
 		log.Fatalf("failed to initialize this config: %e", err)
 	}
 	return newConfig
 }
+
+// handlesMessagePrefix returns true if logical decoding messages with this prefix should be handled
+func (c Config) handlesMessagePrefix(prefix string) bool {
+	if len(c.MessagePrefixes) == 0 {
+		return true
+	}
+	for _, p := range c.MessagePrefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictPolicy returns the conflict policy for a table (see conflict_policy and conflict_policies)
+func (c Config) conflictPolicy(table Table) string {
+	if policy, ok := c.ConflictPolicies[fmt.Sprintf("%s.%s", table.Namespace, table.TableName)]; ok {
+		return policy
+	}
+	return c.ConflictPolicy
+}
+
+// handlesConflicts returns true if conflicts are resolved (and recorded) for any table
+func (c Config) handlesConflicts() bool {
+	if c.ConflictPolicy != "error" {
+		return true
+	}
+	for _, policy := range c.ConflictPolicies {
+		if policy != "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// ddlAllowed returns true if DDL statements with this command tag (e.a. ALTER TABLE) should be replayed
+func (c Config) ddlAllowed(tag string) bool {
+	for _, allowed := range c.DDLAllowlist {
+		if strings.EqualFold(allowed, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+package pg
+
+import (
+	"fmt"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ConflictPolicies are the valid values for conflict_policy (and conflict_policies)
+var ConflictPolicies = map[string]bool{
+	"error":            true,
+	"upsert":           true,
+	"keep_local":       true,
+	"last_writer_wins": true,
+	"conflict_table":   true,
+}
+
+// applyStep is one step that runs on the destination: a statement, or an INSERT, UPDATE or DELETE change
+// (which is applied with a prepared statement, and for which conflicts are detected and resolved).
+type applyStep struct {
+	sql    string
+	change *Transaction
+}
+
+// steps returns all steps that need to run on the destination to apply a transaction (see statements)
+func (c *Conn) steps(t Transaction) (steps []applyStep, err error) {
+	if !t.IsEnvelope() {
+		if t, err = c.config.sourceChange(c.config.mapChange(t)); err != nil {
+			return nil, err
+		}
+	}
+	switch t.Type {
+	case "TRUNCATE":
+		if c.config.SourceColumn != "" {
+			for _, stmt := range c.config.sourceTruncateStatements(t) {
+				steps = append(steps, applyStep{sql: stmt})
+			}
+			return steps, nil
+		}
+	case "INSERT", "UPDATE", "DELETE":
+		if t.Validate() {
+			steps = append(steps, applyStep{change: &t})
+		}
+		return steps, nil
+	}
+	if !t.IsEnvelope() {
+		stmts, sErr := c.statements(t)
+		for _, stmt := range stmts {
+			steps = append(steps, applyStep{sql: stmt})
+		}
+		return steps, sErr
+	}
+	for _, change := range t.Changes {
+		if change.SourceID == "" {
+			change.SourceID = t.SourceID
+		}
+		changeSteps, cErr := c.steps(change)
+		if cErr != nil {
+			return nil, cErr
+		}
+		steps = append(steps, changeSteps...)
+	}
+	return steps, nil
+}
+
+// runSteps runs steps within the current destination transaction, and handles conflicts of changes.
+// The envelope is the source transaction the changes belong to.
+func (c *Conn) runSteps(steps []applyStep, envelope Transaction) (err error) {
+	for _, step := range steps {
+		if step.change == nil {
+			err = c.runStatements([]string{step.sql})
+		} else {
+			err = c.applyChange(*step.change, envelope)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conflictTable returns the table on the destination where conflicts are recorded.
+// It returns an empty string when no conflict policies are configured.
+func (c *Conn) conflictTable() (string, error) {
+	if !c.config.handlesConflicts() {
+		return "", nil
+	}
+	table := identifierNameSql(c.config.ConflictTable)
+	if c.conflictTableCreated {
+		return table, nil
+	}
+	if err := c.RunSQL(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id bigserial PRIMARY KEY, "+
+		"detected timestamptz NOT NULL DEFAULT now(), conflict text NOT NULL, policy text NOT NULL, "+
+		"resolution text NOT NULL, relation text NOT NULL, lsn pg_lsn NOT NULL, xid bigint NOT NULL, "+
+		"change jsonb NOT NULL, envelope jsonb NOT NULL)", table)); err != nil {
+		return "", err
+	}
+	c.conflictTableCreated = true
+	return table, nil
+}
+
+// applyChange runs the statement of an INSERT, UPDATE or DELETE change, and detects conflicts:
+// an INSERT that hits a duplicate key (insert_exists), or an UPDATE or DELETE that matches no rows
+// (update_missing and delete_missing).
+// Unless the policy is error, an INSERT runs with ON CONFLICT DO NOTHING, so that a duplicate key is detected by the
+// row count (instead of by an error, which would require a savepoint for every INSERT).
+func (c *Conn) applyChange(change Transaction, envelope Transaction) (err error) {
+	policy := c.config.conflictPolicy(change.Tables[0])
+	stmt := changeStatement(change)
+	if policy == "last_writer_wins" && change.Type != "INSERT" {
+		// only change rows that were changed locally before the source transaction committed
+		stmt.sql = fmt.Sprintf("%s AND %s", stmt.sql, stmt.localOlder(envelope))
+	} else if policy != "error" && change.Type == "INSERT" {
+		stmt.sql = fmt.Sprintf("%s ON CONFLICT DO NOTHING", stmt.sql)
+	}
+	savepoint := len(c.config.SkipErrors) > 0
+	if savepoint {
+		if err = c.exec("SAVEPOINT pgarrow"); err != nil {
+			return err
+		}
+	}
+	rows, err := c.execStatement(stmt)
+	if err != nil {
+		if savepoint && c.skippable(err) {
+			return c.exec("ROLLBACK TO SAVEPOINT pgarrow")
+		} else if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" && change.Type == "INSERT" {
+			// a duplicate key with the error policy (other policies insert with ON CONFLICT DO NOTHING)
+			return c.resolveConflict("insert_exists", policy, change, envelope)
+		}
+		return err
+	}
+	log.Debugf("succesfully ran %s", stmt.sql)
+	if savepoint {
+		if err = c.exec("RELEASE SAVEPOINT pgarrow"); err != nil {
+			return err
+		}
+	}
+	switch {
+	case rows > 0:
+		return nil
+	case change.Type == "INSERT":
+		return c.resolveConflict("insert_exists", policy, change, envelope)
+	case change.Type == "UPDATE":
+		return c.resolveConflict("update_missing", policy, change, envelope)
+	case change.Type == "DELETE":
+		return c.resolveConflict("delete_missing", policy, change, envelope)
+	}
+	return nil
+}
+
+// resolveConflict resolves a conflict according to the policy, and records it in the conflict_table
+func (c *Conn) resolveConflict(conflict string, policy string, change Transaction, envelope Transaction) (err error) {
+	table := change.Tables[0]
+	switch policy {
+	case "error":
+		body, _ := envelope.Dump()
+		log.Errorf("conflict %s on %s in %s", conflict, table.RelationName(), body)
+		return permanentf("conflict %s on %s (xid %d, lsn %s)", conflict, table.RelationName(), envelope.Xid,
+			pglogrepl.LSN(change.LSN))
+	}
+	resolution := "skip"
+	if policy == "last_writer_wins" && conflict != "insert_exists" {
+		// the row could also be skipped because it was changed locally after the source transaction committed
+		if exists, eErr := c.rowExists(table, change.Where, change.FullIdentity); eErr != nil {
+			return eErr
+		} else if exists && conflict == "update_missing" {
+			conflict = "update_newer"
+		} else if exists {
+			conflict = "delete_newer"
+		}
+	}
+	switch conflict {
+	case "insert_exists":
+		if policy == "upsert" {
+			resolution, err = c.updateExisting(change)
+		} else if policy == "last_writer_wins" {
+			if newer, nErr := c.sourceNewer(change, envelope); nErr != nil {
+				return nErr
+			} else if newer {
+				resolution, err = c.updateExisting(change)
+			}
+		}
+	case "update_missing":
+		if policy == "upsert" || policy == "last_writer_wins" {
+			resolution, err = c.insertMissing(change)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Warnf("conflict %s on %s (xid %d, lsn %s), resolved with %s (policy %s)", conflict, table.RelationName(),
+		envelope.Xid, pglogrepl.LSN(change.LSN), resolution, policy)
+	return c.recordConflict(conflict, policy, resolution, change, envelope)
+}
+
+// recordConflict inserts a conflict, with the change and the complete envelope, into the conflict_table
+func (c *Conn) recordConflict(conflict string, policy string, resolution string, change Transaction,
+	envelope Transaction) error {
+	table, err := c.conflictTable()
+	if err != nil || table == "" {
+		return err
+	}
+	changeBody, err := change.Dump()
+	if err != nil {
+		return err
+	}
+	envelopeBody, err := envelope.Dump()
+	if err != nil {
+		return err
+	}
+	return c.exec(fmt.Sprintf("INSERT INTO %s (conflict, policy, resolution, relation, lsn, xid, change, envelope) "+
+		"VALUES (%s, %s, %s, %s, '%s', %d, %s::jsonb, %s::jsonb)",
+		table,
+		stringValueSql(conflict),
+		stringValueSql(policy),
+		stringValueSql(resolution),
+		stringValueSql(change.Tables[0].RelationName()),
+		pglogrepl.LSN(change.LSN),
+		envelope.Xid,
+		stringValueSql(string(changeBody)),
+		stringValueSql(string(envelopeBody)),
+	))
+}
+
+// primaryKey returns the primary key columns of a destination table
+func (c *Conn) primaryKey(table Table) (columns []string, err error) {
+	if columns, ok := c.primaryKeys[table.RelationName()]; ok {
+		return columns, nil
+	}
+	rows, err := getRows(c.aConn, fmt.Sprintf("SELECT a.attname FROM pg_index i JOIN pg_attribute a "+
+		"ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey) WHERE i.indrelid = %s::regclass AND i.indisprimary",
+		stringValueSql(table.RelationName())))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		columns = append(columns, row["attname"])
+	}
+	if len(columns) == 0 {
+		return nil, permanentf("cannot resolve conflict on %s, which has no primary key", table.RelationName())
+	}
+	c.primaryKeys[table.RelationName()] = columns
+	return columns, nil
+}
+
+// keyWhere returns the primary key columns (with the values of the change) of an INSERT
+func (c *Conn) keyWhere(change Transaction) (Columns, error) {
+	columns, err := c.primaryKey(change.Tables[0])
+	if err != nil {
+		return nil, err
+	}
+	where := make(Columns)
+	for _, column := range columns {
+		value, ok := change.Values[column]
+		if !ok {
+			return nil, permanentf("cannot resolve conflict on %s, primary key column %s is missing",
+				change.Tables[0].RelationName(), column)
+		}
+		where[column] = value
+	}
+	return where, nil
+}
+
+// rowExists returns true if a row matching where exists on the destination
+func (c *Conn) rowExists(table Table, where Columns, nullSafe bool) (bool, error) {
+	var stmt statement
+	stmt.sql = fmt.Sprintf("SELECT 1 AS found FROM %s WHERE %s LIMIT 1", table.RelationName(),
+		stmt.where(where, nullSafe))
+	rows, err := c.queryStatement(stmt)
+	return len(rows) > 0, err
+}
+
+// sourceNewer returns true if the row of an INSERT was last changed on the destination before the
+// source transaction committed
+func (c *Conn) sourceNewer(change Transaction, envelope Transaction) (bool, error) {
+	where, err := c.keyWhere(change)
+	if err != nil {
+		return false, err
+	}
+	var stmt statement
+	stmt.sql = fmt.Sprintf("SELECT %s AS newer FROM %s", stmt.localOlder(envelope), change.Tables[0].RelationName())
+	stmt.sql = fmt.Sprintf("%s WHERE %s", stmt.sql, stmt.where(where, false))
+	rows, err := c.queryStatement(stmt)
+	if err != nil {
+		return false, err
+	}
+	return len(rows) == 0 || rows[0]["newer"] == "t", nil
+}
+
+// updateExisting applies an INSERT that hit a duplicate key as an UPDATE of the existing row
+func (c *Conn) updateExisting(change Transaction) (string, error) {
+	where, err := c.keyWhere(change)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.execStatement(updateStatement(change.Tables[0], change.Values, where, false))
+	return "update", err
+}
+
+// insertMissing applies an UPDATE that matched no rows as an INSERT of the new row.
+// This is not possible when the new row has unchanged TOAST values (which are not sent by the source).
+func (c *Conn) insertMissing(change Transaction) (string, error) {
+	if len(change.Values.unchanged()) > 0 {
+		log.Warnf("cannot insert missing row into %s, since it has unchanged TOAST values",
+			change.Tables[0].RelationName())
+		return "skip", nil
+	}
+	_, err := c.execStatement(insertStatement(change.Tables[0], change.Values))
+	return "insert", err
+}
@@ -0,0 +1,34 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestConflictPolicy(t *testing.T) {
+	c := Config{}
+	if err := c.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if c.ConflictPolicy != "error" || c.handlesConflicts() {
+		t.Errorf("expected the error policy by default, got %s", c.ConflictPolicy)
+	}
+	c.ConflictPolicies = map[string]string{"public.a": "upsert"}
+	if err := c.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.handlesConflicts() {
+		t.Errorf("expected conflicts to be handled with a conflict policy for a table")
+	}
+	for table, expected := range map[Table]string{
+		{Namespace: "public", TableName: "a"}: "upsert",
+		{Namespace: "public", TableName: "b"}: "error",
+	} {
+		if policy := c.conflictPolicy(table); policy != expected {
+			t.Errorf("conflictPolicy(%s): expected %s, got %s", table.RelationName(), expected, policy)
+		}
+	}
+	c.ConflictPolicies["public.a"] = "merge"
+	if err := c.Initialize(); err == nil {
+		t.Errorf("expected an error for an invalid conflict policy")
+	}
+}
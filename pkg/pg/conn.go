@@ -17,8 +17,36 @@ type Conn struct {
 	config                      *Config
 	rConn                       *pgconn.PgConn
 	qConn                       *pgconn.PgConn
+	aConn                       *pgconn.PgConn
 	relationMessages            RelationMessages
+	serverVersion               int
+	current                     *Transaction
+	pending                     bool
+	inStream                    bool
+	txOpen                      bool
+	binary                      bool
+	streamTableCreated          bool
+	messageTableCreated         bool
 	XLogPos                     pglogrepl.LSN
+	FlushLSN                    pglogrepl.LSN
+	savedLSN                    pglogrepl.LSN
+	identity                    pglogrepl.IdentifySystemResult
+	copyPublisher               func(Transaction) error
+	copyTableCreated            bool
+	copyStatus                  map[string]copyState
+	copyPending                 bool
+	originXids                  map[uint32]string
+	originSetUp                 bool
+	conflictTableCreated        bool
+	progressTableCreated        bool
+	progressLoaded              bool
+	progressLSN                 pglogrepl.LSN
+	workers                     []*Conn
+	deadLetterPublisher         func([]byte) error
+	deadLetterTableCreated      bool
+	retries                     int
+	prepared                    map[string]string
+	primaryKeys                 map[string][]string
 	lastPrimaryKeepaliveMessage time.Time
 }
 
@@ -26,6 +54,8 @@ func NewConn(conf *Config) (c *Conn) {
 	return &Conn{
 		config:                      conf,
 		relationMessages:            make(RelationMessages),
+		originXids:                  make(map[uint32]string),
+		primaryKeys:                 make(map[string][]string),
 		lastPrimaryKeepaliveMessage: time.Now(),
 	}
 }
@@ -52,10 +82,38 @@ func (c *Conn) Connect() (err error) {
 		log.Infof("Retrying in 10 seconds")
 		time.Sleep(10 * time.Second)
 	}
+	if c.serverVersion, err = serverMajorVersion(c.rConn); err != nil {
+		return err
+	}
 	if err = c.getPgTypes(); err != nil {
 		return err
 	}
-	log.Debugln("successfully connected to postgres")
+	log.Debugf("successfully connected to postgres (major version %d)", c.serverVersion)
+	return nil
+}
+
+// applyConnect connects the apply connection, which runs all statements on the destination.
+// Unlike the replication connection, it supports the extended protocol (for statements with parameters).
+func (c *Conn) applyConnect() (err error) {
+	if c.aConn != nil {
+		if c.aConn.IsClosed() {
+			c.aConn = nil
+		} else {
+			return nil
+		}
+	}
+	// replication origin sessions and prepared statements are lost with the connection
+	c.originSetUp = false
+	c.prepared = make(map[string]string)
+	for {
+		c.aConn, err = pgconn.Connect(ctx, c.config.DSN.ConnString(false))
+		if err == nil {
+			break
+		}
+		log.Errorln("Cannot connect to Postgres:", err.Error())
+		log.Infof("Retrying in 10 seconds")
+		time.Sleep(10 * time.Second)
+	}
 	return nil
 }
 
@@ -83,6 +141,11 @@ func (c *Conn) MustClose() {
 }
 
 func (c *Conn) Close() (err error) {
+	for _, worker := range c.workers {
+		if err = worker.Close(); err != nil {
+			return err
+		}
+	}
 	if err = _close(c.rConn); err != nil {
 		log.Infof("Error closing rConn")
 		return err
@@ -93,6 +156,11 @@ func (c *Conn) Close() (err error) {
 		return err
 	}
 	c.qConn = nil
+	if err = _close(c.aConn); err != nil {
+		log.Infof("Error closing aConn")
+		return err
+	}
+	c.aConn = nil
 	log.Debugln("connection successfully closed")
 	return nil
 }
@@ -111,39 +179,34 @@ func _close(c *pgconn.PgConn) (err error) {
 }
 
 func (c *Conn) RunSQL(sql string) (err error) {
-	if err = c.Connect(); err != nil {
-		return err
+	if c.txOpen {
+		// retrying (and reconnecting) would silently replace the open transaction, so the error is returned to
+		// transaction(), which reruns the transaction as a whole
+		return c.exec(sql)
 	}
-	log.Debugf("Running SQL: %s", sql)
-	cur := c.rConn.Exec(ctx, sql)
-	if err = cur.Close(); err == nil {
-		return nil
-	} else if pgErr, ok := err.(*pgconn.PgError); !ok {
-		log.Error("Unexpected error while running query: (%T)->%v", err, err)
-		return err
-	} else if pgErr.Code != "57P01" {
-		log.Error("unexpected Postgres error while running query: (%T)->%v", pgErr, pgErr)
-		return pgErr
-	} else if closeErr := c.Close(); closeErr != nil {
-		log.Error("tried to resolve SQLSTATE 57P01 while running query, "+
-			"but closing connection failed: (%T)->%v", closeErr, closeErr)
-		return closeErr
-	}
-	log.Info("recovering from SQLSTATE 57P01, rerunning query")
-	if runErr := c.RunSQL(sql); runErr != nil {
-		log.Error("tried to resolve SQLSTATE 57P01 while running query, "+
-			"but rerunning the query failed: (%T)->%v", runErr, runErr)
-		return runErr
+	_, err = c.withRetries("running query", func(int) error {
+		if cErr := c.applyConnect(); cErr != nil {
+			return cErr
+		}
+		log.Debugf("Running SQL: %s", sql)
+		return c.aConn.Exec(ctx, sql).Close()
+	})
+	if err != nil {
+		log.Errorf("unexpected error while running query: (%T)->%v", err, err)
 	}
-	return nil
+	return err
 }
 
 func (c *Conn) GetRows(query string) (answer []map[string]string, err error) {
 	if err = c.qryConnect(); err != nil {
 		return nil, err
 	}
+	return getRows(c.qConn, query)
+}
+
+func getRows(conn *pgconn.PgConn, query string) (answer []map[string]string, err error) {
 	log.Debugf("Running SQL: %s", query)
-	cur := c.qConn.Exec(ctx, query)
+	cur := conn.Exec(ctx, query)
 	if next := cur.NextResult(); !next {
 		return nil, fmt.Errorf("query did not return results: %s", query)
 	}
@@ -166,7 +229,9 @@ func (c *Conn) GetRows(query string) (answer []map[string]string, err error) {
 }
 
 func (c *Conn) getSlotInfo() (slotInfos, error) {
-	if results, err := c.GetRows("select slot_name, active, restart_lsn from pg_replication_slots"); err != nil {
+	qry := "select slot_name, active, restart_lsn, confirmed_flush_lsn from pg_replication_slots " +
+		"where slot_type = 'logical'"
+	if results, err := c.GetRows(qry); err != nil {
 		return slotInfos{}, err
 	} else {
 		sis := make(slotInfos)
@@ -181,12 +246,17 @@ func (c *Conn) getSlotInfo() (slotInfos, error) {
 				return slotInfos{}, fmt.Errorf("query results misses `restart_lsn` field")
 			} else if restartLsn, err := pglogrepl.ParseLSN(restart); err != nil {
 				return slotInfos{}, err
+			} else if flush, ok := result["confirmed_flush_lsn"]; !ok {
+				return slotInfos{}, fmt.Errorf("query results misses `confirmed_flush_lsn` field")
+			} else if flushLsn, err := pglogrepl.ParseLSN(flush); err != nil {
+				return slotInfos{}, err
 			} else {
-				log.Debugf("Slot: %s, active: %s, restartLSN: %s", name, active, restartLsn)
+				log.Debugf("Slot: %s, active: %s, restartLSN: %s, flushLSN: %s", name, active, restartLsn, flushLsn)
 				sis[name] = slotInfo{
 					name:       name,
 					active:     bActive,
 					restartLsn: restartLsn,
+					flushLsn:   flushLsn,
 				}
 			}
 		}
@@ -223,10 +293,41 @@ func (c *Conn) GetXLogPos() (pglogrepl.LSN, error) {
 		return 0, fmt.Errorf("slot %s is already active", slot.name)
 	} else {
 		c.XLogPos = slot.restartLsn
-		log.Debugf("restart LSN for slot %s: %d", slot.name, c.XLogPos)
+		c.FlushLSN = slot.flushLsn
+		log.Debugf("restart LSN for slot %s: %s, confirmed flush LSN: %s", slot.name, c.XLogPos, c.FlushLSN)
 	}
 	return c.XLogPos, nil
 }
+
+// Confirm should be called after a transaction returned by NextTransactions is safely stored on the message bus.
+// The slot is only advanced up to the end LSN of confirmed transactions, which means that after a crash all
+// transactions that were not confirmed are sent again (at-least-once delivery).
+func (c *Conn) Confirm(t Transaction) {
+	c.pending = false
+	if lsn := pglogrepl.LSN(t.EndLSN); lsn > c.FlushLSN {
+		c.FlushLSN = lsn
+		log.Debugf("confirmed flush LSN %s", c.FlushLSN)
+	}
+}
+
+// standbyStatus returns the positions that can be reported back to postgres.
+// With a state file, only the saved LSN is reported, so that the state file is never behind the slot.
+func (c *Conn) standbyStatus() pglogrepl.StandbyStatusUpdate {
+	if c.current == nil && !c.pending && c.XLogPos > c.FlushLSN {
+		// everything we received is either confirmed or skipped
+		c.FlushLSN = c.XLogPos
+	}
+	flushLSN := c.FlushLSN
+	if c.config.StateFile != "" {
+		c.saveState()
+		flushLSN = c.savedLSN
+	}
+	return pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: c.XLogPos,
+		WALFlushPosition: flushLSN,
+		WALApplyPosition: flushLSN,
+	}
+}
 func (c *Conn) GetTableFromOID(oid uint32) (t Table, err error) {
 	tmpConn := c.Clone()
 	defer tmpConn.MustClose()
@@ -265,16 +366,171 @@ func (c *Conn) ProcessMsg(msg []byte) (err error) {
 	}
 	var t Transaction
 	if t, err = TransactionFromBytes(msg); err != nil {
+		return c.failed(msg, Transaction{}, err)
+	}
+	if applied, aErr := c.applied(t); aErr != nil {
+		return aErr
+	} else if applied {
+		log.Infof("skipping %s (xid %d, lsn %s), which is already applied", t.Type, t.Xid, t.Position())
+		return nil
+	}
+	switch t.Type {
+	case "STREAM":
+		err = c.spoolStream(t)
+	case "STREAM COMMIT":
+		err = c.commitStream(t, "COMMIT")
+	case "STREAM PREPARE":
+		err = c.commitStream(t, prepareSQL(t.GID))
+	case "STREAM ABORT":
+		err = c.abortStream(t)
+	case "PREPARE":
+		err = c.prepareTransaction(t)
+	case "COMMIT PREPARED", "ROLLBACK PREPARED":
+		if err = c.finishPrepared(t, t.Type); err == nil {
+			err = c.setProgress(t)
+		}
+	case "COPY":
+		if err = c.applyCopy(t); err != nil {
+			err = c.failed(msg, t, err)
+		}
+	case "COPY DONE", "COPY END":
+		err = c.copyProgress(t)
+	default:
+		err = c.applyBatch(Transactions{t})
+	}
+	if err != nil {
 		return err
 	}
-	sql := t.Sql()
-	if err = c.RunSQL(sql); err == nil {
-		log.Debugf("succesfully ran %s", sql)
-	} else if pgErr, ok := err.(*pgconn.PgError); !ok {
+	if position := t.Position(); position > c.progressLSN {
+		c.progressLSN = position
+	}
+	log.Debugf("succesfully applied transaction (xid %d, lsn %d)", t.Xid, t.LSN)
+	return nil
+}
+
+// ProcessMsgs applies multiple messages. Consecutive envelopes that do not need a transaction of their own
+// (COMMIT and non-transactional MESSAGE) are applied together in one destination transaction.
+func (c *Conn) ProcessMsgs(msgs [][]byte) (err error) {
+	if c.config.ApplyWorkers > 1 {
+		return c.processParallel(msgs)
+	}
+	var batch Transactions
+	for _, msg := range msgs {
+		t, tErr := TransactionFromBytes(msg)
+		if tErr != nil {
+			if err = c.failed(msg, Transaction{}, tErr); err != nil {
+				return err
+			}
+			continue
+		}
+		switch t.Type {
+		case "STREAM", "STREAM COMMIT", "STREAM PREPARE", "STREAM ABORT", "PREPARE", "COMMIT PREPARED",
+			"ROLLBACK PREPARED", "COPY", "COPY DONE", "COPY END":
+			if err = c.applyBatch(batch); err != nil {
+				return err
+			}
+			batch = nil
+			if err = c.ProcessMsg(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		if applied, aErr := c.applied(t); aErr != nil {
+			return aErr
+		} else if applied {
+			log.Infof("skipping %s (xid %d, lsn %s), which is already applied", t.Type, t.Xid, t.Position())
+			continue
+		}
+		batch = append(batch, t)
+	}
+	return c.applyBatch(batch)
+}
+
+// applyEnvelopes applies envelopes in one destination transaction, together with the progress of the last one
+// (so that the envelopes are applied exactly once)
+func (c *Conn) applyEnvelopes(envelopes Transactions) (err error) {
+	var allSteps [][]applyStep
+	var last Transaction
+	empty := true
+	for _, t := range envelopes {
+		steps, sErr := c.steps(t)
+		if sErr != nil {
+			return sErr
+		}
+		allSteps = append(allSteps, steps)
+		empty = empty && len(steps) == 0
+		if t.Position() > last.Position() {
+			last = t
+		}
+	}
+	var progress string
+	if last.Position() != 0 {
+		if progress, err = c.progressSql(last); err != nil {
+			return err
+		}
+	} else if empty {
+		return nil
+	}
+	if err = c.inTransaction(func() error {
+		if c.retries > 0 && last.Position() != 0 {
+			// the previous attempt could have been committed before the connection was lost
+			if applied, aErr := c.applied(last); aErr != nil {
+				return aErr
+			} else if applied {
+				log.Infof("transaction (lsn %s) was already applied by a previous attempt", last.Position())
+				return nil
+			}
+		}
+		for i, steps := range allSteps {
+			if rErr := c.runSteps(steps, envelopes[i]); rErr != nil {
+				return rErr
+			}
+		}
+		if progress == "" {
+			return nil
+		}
+		return c.exec(progress)
+	}); err != nil {
 		return err
+	}
+	if len(envelopes) > 1 {
+		log.Debugf("succesfully applied %d transactions in one transaction", len(envelopes))
+	}
+	if position := last.Position(); position > c.progressLSN {
+		c.progressLSN = position
+	}
+	return nil
+}
+
+// statements returns all statements that need to run on the destination to apply a transaction.
+// Unlike Transaction.Statements, this also handles changes that depend on the config of the destination.
+func (c *Conn) statements(t Transaction) (stmts []string, err error) {
+	if t.Type == "MESSAGE" {
+		return c.messageStatements(t)
+	} else if t.Type == "DDL" {
+		return c.ddlStatements(t), nil
+	} else if t.Type == "RELATION" {
+		return c.relationStatements(t), nil
+	} else if !t.IsEnvelope() {
+		return t.Statements(), nil
+	}
+	for _, change := range t.Changes {
+		changeStmts, cErr := c.statements(change)
+		if cErr != nil {
+			return nil, cErr
+		}
+		stmts = append(stmts, changeStmts...)
+	}
+	return stmts, nil
+}
+
+// skippable checks if an error can be skipped according to the skip_errors config
+func (c *Conn) skippable(err error) bool {
+	if pgErr, ok := err.(*pgconn.PgError); !ok {
+		return false
 	} else if description, exists := c.config.SkipErrors[pgErr.Code]; exists {
 		log.Debugf("skipping error code %s (%s)", pgErr.Code, description)
-		return nil
+		return true
 	} else {
 		log.Error(pgErr)
 		if ce := quickLog.Check(zap.DebugLevel, "to skip, add this to config"); ce != nil {
@@ -283,9 +539,113 @@ func (c *Conn) ProcessMsg(msg []byte) (err error) {
 				zap.String("value", strings.Replace(pgErr.Message, "\"", "'", -1)),
 			)
 		}
+		return false
+	}
+}
+
+// RunTransaction runs all statements in one destination transaction.
+// When skip_errors are configured, every statement is wrapped in a savepoint so that a skipped error does not
+// abort the rest of the transaction.
+func (c *Conn) RunTransaction(stmts []string) (err error) {
+	if len(stmts) == 0 {
+		return nil
+	}
+	return c.inTransaction(func() error {
+		return c.runStatements(stmts)
+	})
+}
+
+// inTransaction runs apply in one destination transaction
+func (c *Conn) inTransaction(apply func() error) (err error) {
+	return c.transaction(apply, "COMMIT")
+}
+
+// transaction runs apply in one destination transaction that is ended with the end statement
+// (COMMIT or PREPARE TRANSACTION), and reruns it according to the retry policies (see retry).
+// The number of retries is kept in c.retries.
+func (c *Conn) transaction(apply func() error, end string) (err error) {
+	c.retries, err = c.withRetries("running transaction", func(retry int) error {
+		c.retries = retry
+		return c.runTransaction(apply, end)
+	})
+	return err
+}
+
+func (c *Conn) runTransaction(apply func() error, end string) (err error) {
+	if err = c.applyConnect(); err != nil {
+		return err
+	}
+	if err = c.setupOrigin(); err != nil {
+		return err
+	}
+	if err = c.helperTables(); err != nil {
+		return err
+	}
+	if err = c.exec("BEGIN"); err != nil {
+		return err
+	}
+	c.txOpen = true
+	defer func() {
+		c.txOpen = false
+	}()
+	if err = apply(); err != nil {
+		c.rollback()
+		return err
+	}
+	if err = c.exec(end); err != nil {
+		c.rollback()
+		return err
+	}
+	return nil
+}
+
+// helperTables creates the helper tables that are used within destination transactions, before the transaction
+// starts, since these are created with their own transaction
+func (c *Conn) helperTables() error {
+	helpers := []func() (string, error){c.progressTable, c.conflictTable, c.messageTable}
+	if c.config.DeadLetterTarget == "table" && c.config.handlesFailures() {
+		helpers = append(helpers, c.deadLetterTable)
+	}
+	for _, helper := range helpers {
+		if _, err := helper(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		return pgErr
+// runStatements runs statements within the current destination transaction
+func (c *Conn) runStatements(stmts []string) (err error) {
+	for _, stmt := range stmts {
+		sql := stmt
+		if len(c.config.SkipErrors) > 0 {
+			sql = fmt.Sprintf("SAVEPOINT pgarrow; %s; RELEASE SAVEPOINT pgarrow", stmt)
+		}
+		if err = c.exec(sql); err == nil {
+			log.Debugf("succesfully ran %s", stmt)
+		} else if c.skippable(err) {
+			// skippable only returns true for configured skip_errors, so the savepoint exists
+			err = c.exec("ROLLBACK TO SAVEPOINT pgarrow")
+		}
+		if err != nil {
+			return err
+		}
 	}
 	return nil
+}
 
+// rollback tries to roll back the current destination transaction (if the connection is still usable)
+func (c *Conn) rollback() {
+	if c.aConn == nil || c.aConn.IsClosed() {
+		return
+	}
+	if err := c.exec("ROLLBACK"); err != nil {
+		log.Errorf("rollback failed: %v", err)
+	}
+}
+
+// exec runs sql on the apply connection without any error handling
+func (c *Conn) exec(sql string) error {
+	log.Debugf("Running SQL: %s", sql)
+	return c.aConn.Exec(ctx, sql).Close()
 }
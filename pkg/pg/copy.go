@@ -0,0 +1,331 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// OnInitialCopy sets the function that publishes the initial copy (COPY, COPY DONE and COPY END transactions).
+// The initial copy runs when initial_copy is enabled and the replication slot is created.
+func (c *Conn) OnInitialCopy(publish func(Transaction) error) {
+	c.copyPublisher = func(t Transaction) error {
+		t.SourceID = c.config.SourceID
+		return publish(t)
+	}
+}
+
+// startInitialCopy runs the initial copy for a newly created slot. When the copy fails the slot is dropped,
+// so that the copy is retried with a new slot (and snapshot) on the next run.
+func (c *Conn) startInitialCopy(slot pglogrepl.CreateReplicationSlotResult) (err error) {
+	consistentPoint, err := pglogrepl.ParseLSN(slot.ConsistentPoint)
+	if err != nil {
+		return err
+	}
+	if err = c.initialCopy(slot.SnapshotName, consistentPoint); err == nil {
+		return nil
+	}
+	log.Errorf("initial copy failed: %v", err)
+	if dropErr := pglogrepl.DropReplicationSlot(context.Background(), c.rConn, c.config.Slot,
+		pglogrepl.DropReplicationSlotOptions{}); dropErr != nil {
+		log.Errorf("could not drop slot %s after failed initial copy: %v", c.config.Slot, dropErr)
+	}
+	return err
+}
+
+// initialCopy reads all tables in the publications under the snapshot that was exported when the slot was created.
+// All rows are published as INSERT changes in COPY transactions before replication is started, so that
+// the changes from the slot start exactly where the copy ends.
+func (c *Conn) initialCopy(snapshot string, consistentPoint pglogrepl.LSN) (err error) {
+	conn, err := pgconn.Connect(ctx, c.config.DSN.ConnString(false))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := conn.Close(context.Background()); closeErr != nil {
+			log.Errorf("Error closing copy connection: %v", closeErr)
+		}
+	}()
+	if err = conn.Exec(ctx, fmt.Sprintf("BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY; SET TRANSACTION SNAPSHOT %s",
+		stringValueSql(snapshot))).Close(); err != nil {
+		return err
+	}
+	var publications []string
+	for _, publication := range c.config.Publications {
+		publications = append(publications, stringValueSql(publication))
+	}
+	tables, err := getRows(conn, fmt.Sprintf("SELECT DISTINCT schemaname, tablename FROM pg_publication_tables "+
+		"WHERE pubname IN (%s) ORDER BY schemaname, tablename", strings.Join(publications, ", ")))
+	if err != nil {
+		return err
+	}
+	log.Infof("starting initial copy of %d tables (snapshot %s)", len(tables), snapshot)
+	for _, row := range tables {
+		table := Table{Namespace: row["schemaname"], TableName: row["tablename"]}
+		if !c.config.tableIncluded(table) {
+			continue
+		}
+		if err = c.copyTable(conn, table, consistentPoint); err != nil {
+			return err
+		}
+	}
+	if err = c.copyPublisher(Transaction{LSN: uint64(consistentPoint), Type: "COPY END"}); err != nil {
+		return err
+	}
+	log.Infof("initial copy finished")
+	return conn.Exec(ctx, "COMMIT").Close()
+}
+
+// copyTable reads all rows of a table and publishes them in batches of copy_batch_size rows
+func (c *Conn) copyTable(conn *pgconn.PgConn, table Table, consistentPoint pglogrepl.LSN) (err error) {
+	log.Infof("copying %s", table.RelationName())
+	relation, err := relationFromCatalog(conn, table)
+	if err != nil {
+		return err
+	}
+	relationChange, err := c.config.projectChange(Transaction{
+		LSN:      uint64(consistentPoint),
+		Type:     "RELATION",
+		Tables:   Tables{table},
+		Relation: &relation,
+	})
+	if err != nil {
+		return err
+	}
+	batch := Transaction{LSN: uint64(consistentPoint), Type: "COPY", Tables: Tables{table}, Batch: 1,
+		Changes: Transactions{relationChange}}
+	var rows int
+	result := conn.ExecParams(ctx, fmt.Sprintf("SELECT * FROM ONLY %s%s", table.RelationName(),
+		c.config.rowFilterSql(table)), nil, nil, nil, nil)
+	fields := result.FieldDescriptions()
+	for result.NextRow() {
+		values := make(Columns)
+		for i, value := range result.Values() {
+			col := Column{
+				Data: Data{Type: 'n'},
+				Meta: MetaData{
+					Name:     fields[i].Name,
+					TypeOID:  fields[i].DataTypeOID,
+					TypeName: oidToPgType[fields[i].DataTypeOID],
+					Modifier: fields[i].TypeModifier,
+				},
+			}
+			if value != nil {
+				col.Data = Data{
+					Type:   't',
+					Length: uint32(len(value)),
+					// copy, since the result buffer is reused for the next row
+					Data: append([]byte(nil), value...),
+				}
+			}
+			values[fields[i].Name] = col
+		}
+		change, pErr := c.config.projectChange(Transaction{
+			LSN:    uint64(consistentPoint),
+			Type:   "INSERT",
+			Tables: Tables{table},
+			Values: values,
+		})
+		if pErr == nil {
+			pErr = c.copyChange(&batch, change)
+		}
+		if pErr != nil {
+			_, _ = result.Close()
+			return pErr
+		}
+		rows++
+	}
+	if _, err = result.Close(); err != nil {
+		return err
+	}
+	if len(batch.Changes) > 0 {
+		// the first batch is always published (also for an empty table), since it holds the relation
+		if err = c.publishCopyBatch(&batch); err != nil {
+			return err
+		}
+	}
+	log.Infof("copied %d rows from %s", rows, table.RelationName())
+	return c.copyPublisher(Transaction{LSN: uint64(consistentPoint), Type: "COPY DONE", Tables: Tables{table}})
+}
+
+// copyChange adds a change to a batch of the initial copy, and publishes the batch when it is full
+func (c *Conn) copyChange(batch *Transaction, change Transaction) error {
+	batch.Changes = append(batch.Changes, change)
+	if len(batch.Changes) < c.config.CopyBatchSize {
+		return nil
+	}
+	return c.publishCopyBatch(batch)
+}
+
+// publishCopyBatch publishes a batch of the initial copy, and starts the next batch (with the next batch number)
+func (c *Conn) publishCopyBatch(batch *Transaction) error {
+	if err := c.copyPublisher(*batch); err != nil {
+		return err
+	}
+	batch.Batch++
+	batch.Changes = nil
+	return nil
+}
+
+// copyState is the progress of the initial copy of one relation on the destination
+type copyState struct {
+	lsn   pglogrepl.LSN
+	batch int
+	done  bool
+}
+
+// copyRelation returns the relation that a COPY, COPY DONE or COPY END transaction keeps progress for
+// ('*' for the initial copy as a whole)
+func copyRelation(t Transaction) string {
+	if t.Type == "COPY END" || len(t.Tables) == 0 {
+		return "*"
+	}
+	return fmt.Sprintf("%s.%s", t.Tables[0].Namespace, t.Tables[0].TableName)
+}
+
+// copyStatusTable returns the table that keeps track of the progress of the initial copy on the destination
+func (c *Conn) copyStatusTable() (string, error) {
+	table := identifierNameSql(c.config.CopyTable)
+	if c.copyTableCreated {
+		return table, nil
+	}
+	if err := c.RunSQL(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (relation text PRIMARY KEY, lsn pg_lsn NOT NULL, "+
+		"batch int NOT NULL DEFAULT 0, done boolean NOT NULL DEFAULT false, "+
+		"updated timestamptz NOT NULL DEFAULT now())", table)); err != nil {
+		return "", err
+	}
+	c.copyTableCreated = true
+	return table, nil
+}
+
+// copyStates returns the progress of the initial copy per relation, as stored on the destination
+func (c *Conn) copyStates() (map[string]copyState, error) {
+	if c.copyStatus != nil {
+		return c.copyStatus, nil
+	}
+	table, err := c.copyStatusTable()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.GetRows(fmt.Sprintf("SELECT relation, lsn, batch, done FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]copyState)
+	for _, row := range rows {
+		var state copyState
+		if state.lsn, err = pglogrepl.ParseLSN(row["lsn"]); err != nil {
+			return nil, err
+		} else if state.batch, err = strconv.Atoi(row["batch"]); err != nil {
+			return nil, err
+		}
+		state.done = row["done"] == "t"
+		states[row["relation"]] = state
+	}
+	c.copyStatus = states
+	return states, nil
+}
+
+// copied returns true if a COPY batch (or the COPY DONE of its table) of the same initial copy was already applied,
+// which happens when the initial copy is delivered again after a crash of the reader.
+// Batches of an initial copy with another snapshot (after the copy was restarted by the producer) are applied again.
+func (c *Conn) copied(t Transaction) (bool, error) {
+	states, err := c.copyStates()
+	if err != nil {
+		return false, err
+	}
+	state, ok := states[copyRelation(t)]
+	if !ok || state.lsn != pglogrepl.LSN(t.LSN) {
+		return false, nil
+	}
+	return state.done || (t.Type == "COPY" && state.batch >= t.Batch), nil
+}
+
+// copyProgressSql returns the statement that stores the progress of the initial copy of a relation
+func (c *Conn) copyProgressSql(relation string, state copyState) (string, error) {
+	table, err := c.copyStatusTable()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("INSERT INTO %s (relation, lsn, batch, done) VALUES (%s, '%s', %d, %t) "+
+		"ON CONFLICT (relation) DO UPDATE SET lsn = EXCLUDED.lsn, batch = EXCLUDED.batch, done = EXCLUDED.done, "+
+		"updated = now()", table, stringValueSql(relation), state.lsn, state.batch, state.done), nil
+}
+
+// applyCopy applies a batch of the initial copy in one destination transaction, together with the progress of its
+// table (so that every batch is applied exactly once). The first batch of a table truncates the table, so that a copy
+// that is loaded again (e.a. after the copy was restarted by the producer) starts from scratch.
+func (c *Conn) applyCopy(t Transaction) (err error) {
+	if len(t.Tables) != 1 || t.Batch < 1 {
+		return permanentf("COPY transaction (lsn %s) without table or batch number", pglogrepl.LSN(t.LSN))
+	}
+	relation := copyRelation(t)
+	if copied, cErr := c.copied(t); cErr != nil {
+		return cErr
+	} else if copied {
+		log.Infof("skipping batch %d of the initial copy of %s, which is already loaded", t.Batch, relation)
+		return nil
+	}
+	if t.Batch == 1 {
+		t.Changes = append(Transactions{{LSN: t.LSN, Type: "TRUNCATE", Tables: t.Tables, SourceID: t.SourceID}},
+			t.Changes...)
+	}
+	steps, err := c.steps(t)
+	if err != nil {
+		return err
+	}
+	state := copyState{lsn: pglogrepl.LSN(t.LSN), batch: t.Batch}
+	progress, err := c.copyProgressSql(relation, state)
+	if err != nil {
+		return err
+	}
+	if err = c.inTransaction(func() error {
+		if rErr := c.runSteps(steps, t); rErr != nil {
+			return rErr
+		}
+		return c.exec(progress)
+	}); err != nil {
+		return err
+	}
+	c.copyStatus[relation] = state
+	return nil
+}
+
+// copyProgress stores a COPY DONE (for one table) or COPY END (relation '*') marker on the destination
+func (c *Conn) copyProgress(t Transaction) (err error) {
+	states, err := c.copyStates()
+	if err != nil {
+		return err
+	}
+	relation := copyRelation(t)
+	state := copyState{lsn: pglogrepl.LSN(t.LSN), done: true}
+	if previous, ok := states[relation]; ok && previous.lsn == state.lsn {
+		state.batch = previous.batch
+	}
+	progress, err := c.copyProgressSql(relation, state)
+	if err != nil {
+		return err
+	} else if err = c.RunSQL(progress); err != nil {
+		return err
+	}
+	states[relation] = state
+	if t.Type == "COPY END" {
+		log.Infof("initial copy is loaded")
+	} else {
+		log.Infof("initial copy of %s is loaded", relation)
+	}
+	return nil
+}
+
+// CopyFinished returns true when the initial copy has completely been loaded into the destination
+func (c *Conn) CopyFinished() (bool, error) {
+	states, err := c.copyStates()
+	if err != nil {
+		return false, err
+	}
+	return states["*"].done, nil
+}
@@ -0,0 +1,76 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestCopyBatches(t *testing.T) {
+	var published Transactions
+	c := &Conn{
+		config: &Config{CopyBatchSize: 1000},
+		copyPublisher: func(t Transaction) error {
+			published = append(published, t)
+			return nil
+		},
+	}
+	table := Table{Namespace: "public", TableName: "orders"}
+	batch := Transaction{LSN: 100, Type: "COPY", Tables: Tables{table}, Batch: 1,
+		Changes: Transactions{{LSN: 100, Type: "RELATION", Tables: Tables{table}, Relation: &Relation{}}}}
+	for i := 0; i < 2500; i++ {
+		if err := c.copyChange(&batch, Transaction{LSN: 100, Type: "INSERT", Tables: Tables{table}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.publishCopyBatch(&batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 3 {
+		t.Fatalf("expected 3 batches, got %d", len(published))
+	}
+	var rows int
+	for i, b := range published {
+		if b.Batch != i+1 {
+			t.Errorf("batch %d: expected batch number %d, got %d", i, i+1, b.Batch)
+		}
+		for j, change := range b.Changes {
+			if isRelation := change.Type == "RELATION"; isRelation != (i == 0 && j == 0) {
+				t.Errorf("batch %d: unexpected %s change at %d", b.Batch, change.Type, j)
+			} else if !isRelation {
+				rows++
+			}
+		}
+	}
+	if rows != 2500 {
+		t.Errorf("expected 2500 rows, got %d", rows)
+	}
+
+	// after a crash of the reader, batches up to the stored batch are skipped, and the rest is loaded
+	c.copyStatus = map[string]copyState{"public.orders": {lsn: 100, batch: 1}}
+	for _, test := range []struct {
+		t      Transaction
+		copied bool
+	}{
+		{published[0], true},
+		{published[1], false},
+		{published[2], false},
+		{Transaction{LSN: 100, Type: "COPY DONE", Tables: Tables{table}}, false},
+		{Transaction{LSN: 100, Type: "COPY END"}, false},
+	} {
+		if copied, err := c.copied(test.t); err != nil {
+			t.Fatal(err)
+		} else if copied != test.copied {
+			t.Errorf("copied(%s batch %d): expected %v, got %v", test.t.Type, test.t.Batch, test.copied, copied)
+		}
+	}
+	// a table that is done is skipped completely, and a copy with another snapshot is loaded again
+	c.copyStatus = map[string]copyState{"public.orders": {lsn: 100, batch: 3, done: true}}
+	for _, b := range published {
+		if copied, err := c.copied(b); err != nil || !copied {
+			t.Errorf("copied(batch %d) of a table that is done: expected true, got %v (%v)", b.Batch, copied, err)
+		}
+		b.LSN = 200
+		if copied, err := c.copied(b); err != nil || copied {
+			t.Errorf("copied(batch %d) of another snapshot: expected false, got %v (%v)", b.Batch, copied, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package pg
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ddlMessagePrefix is the prefix of the logical decoding messages that are emitted by the DDL capture event trigger
+	ddlMessagePrefix = "pgarrow_ddl"
+	ddlCaptureName   = "pgarrow_ddl_capture"
+)
+
+var reDollarQuote = regexp.MustCompile(`^\$([\pL_][\pL\pN_]*)?\$`)
+
+// DDLCommand is a DDL statement as captured by the event trigger on the source
+type DDLCommand struct {
+	Tag        string `json:"tag"`
+	Query      string `json:"query"`
+	SearchPath string `json:"search_path"`
+}
+
+// installDDLCapture installs an event trigger on the source, which emits every DDL statement as a transactional
+// logical decoding message. That way DDL is decoded in LSN order with (and in the same transaction as) the DML.
+func (c *Conn) installDDLCapture() (err error) {
+	function := fmt.Sprintf(`CREATE OR REPLACE FUNCTION %[1]s() RETURNS event_trigger LANGUAGE plpgsql AS $$
+BEGIN
+  PERFORM pg_logical_emit_message(true, %[2]s, json_build_object('tag', tg_tag, 'query', current_query(),
+    'search_path', current_setting('search_path'))::text);
+END
+$$`, identifierNameSql(ddlCaptureName), stringValueSql(ddlMessagePrefix))
+	if err = c.RunSQL(function); err != nil {
+		return err
+	}
+	rows, err := c.GetRows(fmt.Sprintf("SELECT evtname FROM pg_event_trigger WHERE evtname = %s",
+		stringValueSql(ddlCaptureName)))
+	if err != nil || len(rows) > 0 {
+		return err
+	}
+	log.Infof("installing DDL capture event trigger %s", ddlCaptureName)
+	return c.RunSQL(fmt.Sprintf("CREATE EVENT TRIGGER %[1]s ON ddl_command_end EXECUTE FUNCTION %[1]s()",
+		identifierNameSql(ddlCaptureName)))
+}
+
+// ddlChange converts a logical decoding message from the DDL capture event trigger into a DDL change.
+// The event trigger fires for every command, but captures the complete query. When one query holds multiple DDL
+// commands, the query is only added once.
+func (c *Conn) ddlChange(m Transaction) (ddl Transaction, add bool, err error) {
+	var command DDLCommand
+	if err = json.Unmarshal(m.Message.Content, &command); err != nil {
+		return ddl, false, fmt.Errorf("could not parse captured DDL: %w", err)
+	}
+	if c.current != nil {
+		for _, change := range c.current.Changes {
+			if change.DDL != nil && change.DDL.Query == command.Query {
+				log.Debugf("skipping %s, query was already captured in this transaction", command.Tag)
+				return ddl, false, nil
+			}
+		}
+	}
+	return Transaction{
+		LSN:  m.LSN,
+		Xid:  m.Xid,
+		Type: "DDL",
+		DDL:  &command,
+	}, true, nil
+}
+
+// ddlStatements returns the statements to replay a DDL change on the destination,
+// but only for command tags that are in the ddl_allowlist.
+// The event trigger captures the complete query, which could hold other statements (e.a. `ALTER TABLE a ...;
+// DROP TABLE b`) or run the DDL from a function (e.a. `SELECT f()`, which would also replay the DML of f).
+// Such queries are never replayed, only a query with one statement that starts like its command tag is.
+func (c *Conn) ddlStatements(t Transaction) []string {
+	if !c.config.ddlAllowed(t.DDL.Tag) {
+		log.Warnf("skipping DDL (%s is not in ddl_allowlist): %s", t.DDL.Tag, t.DDL.Query)
+		return nil
+	}
+	if statements := sqlStatements(t.DDL.Query); len(statements) != 1 {
+		log.Errorf("skipping DDL (%s), the query holds %d statements and cannot be replayed, apply it manually: %s",
+			t.DDL.Tag, len(statements), t.DDL.Query)
+		return nil
+	} else if !strings.EqualFold(firstWord(statements[0]), firstWord(t.DDL.Tag)) {
+		log.Errorf("skipping DDL (%s), the query is not a %s statement and cannot be replayed, apply it manually: %s",
+			t.DDL.Tag, t.DDL.Tag, t.DDL.Query)
+		return nil
+	}
+	log.Infof("replaying DDL: %s", t.DDL.Query)
+	return []string{
+		fmt.Sprintf("SELECT set_config('search_path', %s, true)", stringValueSql(t.DDL.SearchPath)),
+		t.DDL.Query,
+	}
+}
+
+// firstWord returns the first word of a statement (or command tag)
+func firstWord(statement string) string {
+	if words := strings.Fields(statement); len(words) > 0 {
+		return words[0]
+	}
+	return ""
+}
+
+// sqlStatements splits a query string into its (non-empty) statements, without comments.
+// Semicolons in quoted strings, quoted identifiers and dollar quoted strings do not end a statement.
+func sqlStatements(query string) (statements []string) {
+	var current strings.Builder
+	for i := 0; i < len(query); {
+		end := i + 1
+		switch {
+		case query[i] == ';':
+			if statement := strings.TrimSpace(current.String()); statement != "" {
+				statements = append(statements, statement)
+			}
+			current.Reset()
+			i++
+			continue
+		case query[i] == '\'' || query[i] == '"':
+			// E'...' strings can escape quotes with a backslash
+			escapes := query[i] == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') &&
+				(i == 1 || !isIdentifierChar(query[i-2]))
+			end = quotedEnd(query, i, escapes)
+		case strings.HasPrefix(query[i:], "--"):
+			if end = strings.IndexByte(query[i:], '\n'); end < 0 {
+				end = len(query)
+			} else {
+				end += i
+			}
+			current.WriteByte(' ')
+			i = end
+			continue
+		case strings.HasPrefix(query[i:], "/*"):
+			// comments can be nested
+			depth := 0
+			for end = i; end < len(query); end++ {
+				if strings.HasPrefix(query[end:], "/*") {
+					depth++
+					end++
+				} else if strings.HasPrefix(query[end:], "*/") {
+					depth--
+					end++
+					if depth == 0 {
+						end++
+						break
+					}
+				}
+			}
+			if end > len(query) {
+				end = len(query)
+			}
+			current.WriteByte(' ')
+			i = end
+			continue
+		case query[i] == '$' && (i == 0 || !isIdentifierChar(query[i-1])):
+			if tag := reDollarQuote.FindString(query[i:]); tag != "" {
+				if closing := strings.Index(query[i+len(tag):], tag); closing < 0 {
+					end = len(query)
+				} else {
+					end = i + len(tag) + closing + len(tag)
+				}
+			}
+		}
+		current.WriteString(query[i:end])
+		i = end
+	}
+	if statement := strings.TrimSpace(current.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+// quotedEnd returns the position after the closing quote of a quoted string (or identifier) that starts at start.
+// A doubled quote is part of the string.
+func quotedEnd(query string, start int, escapes bool) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		if escapes && query[i] == '\\' {
+			i++
+		} else if query[i] == quote {
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
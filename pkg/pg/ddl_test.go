@@ -0,0 +1,65 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestSqlStatements(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"ALTER TABLE a ADD COLUMN b int", []string{"ALTER TABLE a ADD COLUMN b int"}},
+		{"ALTER TABLE a ADD COLUMN b int;", []string{"ALTER TABLE a ADD COLUMN b int"}},
+		{"ALTER TABLE a ADD COLUMN b int; DROP TABLE b;", []string{"ALTER TABLE a ADD COLUMN b int", "DROP TABLE b"}},
+		{"COMMENT ON TABLE a IS 'x; y'", []string{"COMMENT ON TABLE a IS 'x; y'"}},
+		{"COMMENT ON TABLE a IS 'it''s; ok'", []string{"COMMENT ON TABLE a IS 'it''s; ok'"}},
+		{`COMMENT ON TABLE a IS E'it\'s; ok'`, []string{`COMMENT ON TABLE a IS E'it\'s; ok'`}},
+		{`CREATE TABLE "a;b" (c int)`, []string{`CREATE TABLE "a;b" (c int)`}},
+		{"CREATE FUNCTION f() RETURNS void LANGUAGE sql AS $$ DELETE FROM a; $$",
+			[]string{"CREATE FUNCTION f() RETURNS void LANGUAGE sql AS $$ DELETE FROM a; $$"}},
+		{"CREATE FUNCTION f() RETURNS void LANGUAGE sql AS $body$ SELECT '$$;'; $body$; DROP TABLE b",
+			[]string{"CREATE FUNCTION f() RETURNS void LANGUAGE sql AS $body$ SELECT '$$;'; $body$", "DROP TABLE b"}},
+		{"-- add a column; really\nALTER TABLE a ADD COLUMN b int; -- done", []string{"ALTER TABLE a ADD COLUMN b int"}},
+		{"/* first; /* nested; */ */ DROP TABLE a", []string{"DROP TABLE a"}},
+		{" ; ; ", nil},
+	} {
+		statements := sqlStatements(test.query)
+		if len(statements) != len(test.expected) {
+			t.Errorf("sqlStatements(%q): expected %q, got %q", test.query, test.expected, statements)
+			continue
+		}
+		for i, statement := range statements {
+			if statement != test.expected[i] {
+				t.Errorf("sqlStatements(%q): expected %q, got %q", test.query, test.expected[i], statement)
+			}
+		}
+	}
+}
+
+func TestDDLStatements(t *testing.T) {
+	c := &Conn{config: &Config{DDLAllowlist: []string{"ALTER TABLE", "CREATE TABLE"}}}
+	for _, test := range []struct {
+		tag      string
+		query    string
+		replayed bool
+	}{
+		{"ALTER TABLE", "ALTER TABLE a ADD COLUMN b int;", true},
+		{"CREATE TABLE", "/* audit */ create table a (b int)", true},
+		{"DROP TABLE", "DROP TABLE a", false},
+		{"ALTER TABLE", "ALTER TABLE a ADD COLUMN b int; DROP TABLE b;", false},
+		{"ALTER TABLE", "ALTER TABLE a ADD COLUMN b int; ALTER TABLE a ADD COLUMN c int", false},
+		{"ALTER TABLE", "SELECT f()", false},
+		{"CREATE TABLE", "DO $$ BEGIN CREATE TABLE a (b int); END $$", false},
+	} {
+		statements := c.ddlStatements(Transaction{Type: "DDL", DDL: &DDLCommand{Tag: test.tag, Query: test.query,
+			SearchPath: "public"}})
+		if replayed := len(statements) > 0; replayed != test.replayed {
+			t.Errorf("ddlStatements(%s: %q): expected replayed %v, got %v", test.tag, test.query, test.replayed,
+				replayed)
+		} else if replayed && statements[len(statements)-1] != test.query {
+			t.Errorf("ddlStatements(%s: %q): expected the query to be replayed, got %q", test.tag, test.query,
+				statements)
+		}
+	}
+}
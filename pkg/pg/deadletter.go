@@ -0,0 +1,229 @@
+package pg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// FailurePolicies are the valid values for failure_policy (and failure_policies), with their strictness.
+// When an envelope has changes of multiple tables, the strictest policy of these tables is used.
+var FailurePolicies = map[string]int{
+	"skip":        0,
+	"dead_letter": 1,
+	"stop":        2,
+}
+
+// DeadLetter is an envelope that failed to apply, as it is published to the dead letter topic (or queue).
+// Envelope holds the message as it was received (which could be invalid).
+type DeadLetter struct {
+	Pipeline string
+	LSN      uint64
+	Xid      uint32
+	Error    string
+	SQLState string
+	Failed   time.Time
+	Envelope string
+}
+
+// permanentFailure is an error that is not raised by the destination, but would occur again when the same envelope is
+// applied again (e.a. a conflict with conflict policy error, or a table without primary key)
+type permanentFailure struct {
+	error
+}
+
+func (pf permanentFailure) Unwrap() error {
+	return pf.error
+}
+
+// permanentf returns a permanentFailure with a formatted error
+func permanentf(format string, a ...interface{}) error {
+	return permanentFailure{fmt.Errorf(format, a...)}
+}
+
+// OnDeadLetter sets the function that publishes dead letters, for dead_letter_target `broker`
+func (c *Conn) OnDeadLetter(publish func([]byte) error) {
+	c.deadLetterPublisher = publish
+}
+
+// failurePolicy returns the failure policy of an envelope (see failure_policy and failure_policies)
+func (c Config) failurePolicy(t Transaction) string {
+	policy := c.FailurePolicy
+	tables := append(Tables{}, t.Tables...)
+	for _, change := range t.Changes {
+		tables = append(tables, change.Tables...)
+	}
+	for _, table := range tables {
+		if tablePolicy, ok := c.FailurePolicies[fmt.Sprintf("%s.%s", table.Namespace, table.TableName)]; ok &&
+			FailurePolicies[tablePolicy] > FailurePolicies[policy] {
+			policy = tablePolicy
+		}
+	}
+	return policy
+}
+
+// handlesFailures returns true if any failure policy other than stop is configured
+func (c Config) handlesFailures() bool {
+	if c.FailurePolicy != "stop" {
+		return true
+	}
+	for _, policy := range c.FailurePolicies {
+		if policy != "stop" {
+			return true
+		}
+	}
+	return false
+}
+
+// permanentError returns true if applying the same envelope again would fail again: a permanentFailure, or an error
+// that was raised by the destination. Connection errors and all errors with a retry policy (see retry) are transient,
+// and not permanent.
+func (c Config) permanentError(err error) bool {
+	var pf permanentFailure
+	if errors.As(err, &pf) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	_, _, retried := c.Retry.policy(pgErr.Code)
+	return !retried
+}
+
+// deadLetterTable returns the table on the destination where dead letters are stored
+func (c *Conn) deadLetterTable() (string, error) {
+	table := identifierNameSql(c.config.DeadLetterTable)
+	if c.deadLetterTableCreated {
+		return table, nil
+	}
+	if err := c.RunSQL(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id bigserial PRIMARY KEY, "+
+		"failed timestamptz NOT NULL DEFAULT now(), pipeline text NOT NULL, lsn pg_lsn NOT NULL, xid bigint NOT NULL, "+
+		"error text NOT NULL, sqlstate text, envelope text NOT NULL)", table)); err != nil {
+		return "", err
+	}
+	c.deadLetterTableCreated = true
+	return table, nil
+}
+
+// failed handles an envelope that could not be applied (or a message that could not be parsed, in which case t is
+// empty), according to its failure policy: it returns the error (stop), or skips the envelope (skip), after storing it
+// with the error in the dead letter target (dead_letter). A skipped envelope is stored as progress, so that it is not
+// applied again.
+// Only COMMIT, COPY and (non-transactional) MESSAGE envelopes can be skipped, since skipping a part of a streamed
+// or prepared transaction would leave the rest of that transaction behind.
+func (c *Conn) failed(msg []byte, t Transaction, err error) error {
+	switch t.Type {
+	case "", "COMMIT", "COPY", "MESSAGE":
+	default:
+		return err
+	}
+	if t.Type != "" && !c.config.permanentError(err) {
+		return err
+	}
+	policy := c.config.failurePolicy(t)
+	if policy == "stop" {
+		return err
+	}
+	log.Errorf("failed to apply %s (xid %d, lsn %s), handled with failure policy %s: %v", t.Type, t.Xid,
+		t.Position(), policy, err)
+	var stmts []string
+	if policy == "dead_letter" {
+		if msg == nil {
+			var dErr error
+			if msg, dErr = t.Dump(); dErr != nil {
+				return dErr
+			}
+		}
+		letter := DeadLetter{
+			Pipeline: c.config.Pipeline,
+			LSN:      uint64(t.Position()),
+			Xid:      t.Xid,
+			Error:    err.Error(),
+			Failed:   time.Now(),
+			Envelope: string(msg),
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			letter.SQLState = pgErr.Code
+		}
+		if stmt, dErr := c.deadLetter(letter); dErr != nil {
+			return dErr
+		} else if stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	if t.Position() != 0 {
+		progress, pErr := c.progressSql(t)
+		if pErr != nil {
+			return pErr
+		}
+		stmts = append(stmts, progress)
+	}
+	if rErr := c.RunTransaction(stmts); rErr != nil {
+		return rErr
+	}
+	if position := t.Position(); position > c.progressLSN {
+		c.progressLSN = position
+	}
+	return nil
+}
+
+// deadLetter publishes a dead letter (dead_letter_target broker), or returns the statement that stores it in the
+// dead_letter_table (dead_letter_target table)
+func (c *Conn) deadLetter(letter DeadLetter) (string, error) {
+	if c.config.DeadLetterTarget == "broker" {
+		if c.deadLetterPublisher == nil {
+			return "", fmt.Errorf("dead_letter_target broker is not supported for this direction")
+		}
+		raw, err := json.Marshal(letter)
+		if err != nil {
+			return "", err
+		}
+		return "", c.deadLetterPublisher(raw)
+	}
+	table, err := c.deadLetterTable()
+	if err != nil {
+		return "", err
+	}
+	sqlState := "NULL"
+	if letter.SQLState != "" {
+		sqlState = stringValueSql(letter.SQLState)
+	}
+	return fmt.Sprintf("INSERT INTO %s (pipeline, lsn, xid, error, sqlstate, envelope) "+
+		"VALUES (%s, '%s', %d, %s, %s, %s)", table, stringValueSql(letter.Pipeline), pglogrepl.LSN(letter.LSN),
+		letter.Xid, stringValueSql(letter.Error), sqlState, stringValueSql(letter.Envelope)), nil
+}
+
+// applyBatch applies envelopes in one destination transaction. When that fails and failures are handled
+// (see failure_policy), the envelopes are applied one by one, so that only the envelope that fails is handled.
+func (c *Conn) applyBatch(batch Transactions) error {
+	err := c.applyEnvelopes(batch)
+	if err == nil || !c.config.handlesFailures() || !c.config.permanentError(err) {
+		return err
+	} else if len(batch) == 1 {
+		return c.failed(nil, batch[0], err)
+	}
+	return c.applyEach(batch)
+}
+
+// applyEach applies envelopes one by one (each in its own destination transaction), and handles failures
+func (c *Conn) applyEach(envelopes Transactions) error {
+	for _, t := range envelopes {
+		if applied, err := c.applied(t); err != nil {
+			return err
+		} else if applied {
+			continue
+		}
+		if err := c.applyEnvelopes(Transactions{t}); err != nil {
+			if err = c.failed(nil, t, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package pg
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestPermanentError(t *testing.T) {
+	c := Config{Retry: RetryPolicies{}}
+	if err := c.Retry.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		err       error
+		permanent bool
+	}{
+		{&pgconn.PgError{Code: "23505"}, true},
+		{fmt.Errorf("error applying: %w", &pgconn.PgError{Code: "22P02"}), true},
+		{&pgconn.PgError{Code: "40001"}, false},
+		{&pgconn.PgError{Code: "08006"}, false},
+		{&pgconn.PgError{Code: "53100"}, false},
+		{errors.New("connection reset by peer"), false},
+		{permanentf("conflict on %s", "public.orders"), true},
+		{fmt.Errorf("worker 1: %w", permanentf("no primary key")), true},
+	} {
+		if permanent := c.permanentError(test.err); permanent != test.permanent {
+			t.Errorf("permanentError(%v): expected %v, got %v", test.err, test.permanent, permanent)
+		}
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	c := Config{
+		FailurePolicy:   "skip",
+		FailurePolicies: map[string]string{"public.a": "stop", "public.b": "dead_letter"},
+	}
+	a := Table{Namespace: "public", TableName: "a"}
+	b := Table{Namespace: "public", TableName: "b"}
+	other := Table{Namespace: "public", TableName: "other"}
+	for _, test := range []struct {
+		name     string
+		t        Transaction
+		expected string
+	}{
+		{"no tables", Transaction{Type: "COMMIT"}, "skip"},
+		{"other table", Transaction{Type: "COMMIT", Changes: Transactions{{Type: "INSERT", Tables: Tables{other}}}},
+			"skip"},
+		{"dead letter table", Transaction{Type: "COMMIT", Changes: Transactions{
+			{Type: "INSERT", Tables: Tables{other}}, {Type: "INSERT", Tables: Tables{b}},
+		}}, "dead_letter"},
+		{"strictest table", Transaction{Type: "COMMIT", Changes: Transactions{
+			{Type: "INSERT", Tables: Tables{b}}, {Type: "TRUNCATE", Tables: Tables{other, a}},
+		}}, "stop"},
+		{"copy", Transaction{Type: "COPY", Tables: Tables{b}}, "dead_letter"},
+	} {
+		if policy := c.failurePolicy(test.t); policy != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, policy)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package pg
+
+import (
+	"fmt"
+	"math/big"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+)
+
+var reRowCondition = regexp.MustCompile(`(?i)^\s*("(?:[^"]|"")+"|[a-z_][a-z0-9_$]*)\s*` +
+	`(=|<>|!=|<=|>=|<|>|IS\s+NOT\s+NULL|IS\s+NULL)\s*('(?:[^']|'')*'|-?[0-9]+(?:\.[0-9]+)?)?\s*(?:AND\s+|$)`)
+
+// rowCondition is one condition of a row filter, e.a. `region = 'EU'` or `deleted_at IS NULL`
+type rowCondition struct {
+	column   string
+	operator string
+	value    string
+	numeric  bool
+}
+
+// rowFilter is a row predicate with conditions that all need to be true
+type rowFilter []rowCondition
+
+// parseRowFilter parses a row predicate, which is a list of conditions joined with AND.
+// Every condition compares a column with a literal (a quoted string or a number), or checks for NULL.
+// Strings are only compared for equality, since pgarrow cannot order them by the collation of the source.
+// Since this is valid SQL, the same predicate can be used in a where clause on the source.
+func parseRowFilter(predicate string) (filter rowFilter, err error) {
+	remaining := predicate
+	for strings.TrimSpace(remaining) != "" {
+		match := reRowCondition.FindStringSubmatch(remaining)
+		if match == nil {
+			return nil, fmt.Errorf("invalid row filter %s (near %s)", predicate, remaining)
+		}
+		condition := rowCondition{
+			column:   match[1],
+			operator: strings.ToUpper(strings.Join(strings.Fields(match[2]), " ")),
+		}
+		if strings.HasPrefix(condition.column, `"`) {
+			condition.column = strings.ReplaceAll(condition.column[1:len(condition.column)-1], `""`, `"`)
+		} else {
+			condition.column = strings.ToLower(condition.column)
+		}
+		if isNull := strings.HasPrefix(condition.operator, "IS "); isNull && match[3] != "" {
+			return nil, fmt.Errorf("invalid row filter %s (%s does not take a value)", predicate, condition.operator)
+		} else if !isNull && match[3] == "" {
+			return nil, fmt.Errorf("invalid row filter %s (%s requires a value)", predicate, condition.operator)
+		}
+		if strings.HasPrefix(match[3], "'") {
+			condition.value = strings.ReplaceAll(match[3][1:len(match[3])-1], "''", "'")
+			if condition.operator != "=" && condition.operator != "<>" && condition.operator != "!=" {
+				return nil, fmt.Errorf("invalid row filter %s (strings can only be compared with = and <>, since "+
+					"their order depends on the collation)", predicate)
+			}
+		} else {
+			condition.value = match[3]
+			condition.numeric = match[3] != ""
+		}
+		filter = append(filter, condition)
+		remaining = remaining[len(match[0]):]
+	}
+	if len(filter) == 0 {
+		return nil, fmt.Errorf("empty row filter")
+	}
+	return filter, nil
+}
+
+// columnText returns the text representation of a column, and false if the value is unknown
+// (the column is not part of the change, or it is an unchanged TOAST value)
+func columnText(cvs Columns, name string) (text *string, known bool, err error) {
+	col, ok := cvs[name]
+	if !ok || !col.Data.Changed() {
+		return nil, false, nil
+	}
+	switch col.Data.Type {
+	case 'n':
+		return nil, true, nil
+	case 'b':
+		value, bErr := binaryToText(col.Data.Data, col.Meta.TypeOID, col.Meta.TypeName)
+		if bErr != nil {
+			return nil, false, fmt.Errorf("error decoding binary %s column %s: %w", col.Meta.TypeName, name, bErr)
+		}
+		return &value, true, nil
+	}
+	value := string(col.Data.Data)
+	return &value, true, nil
+}
+
+// matches returns true if the condition is true for these columns.
+// When the column value is unknown, the condition is assumed to be true.
+func (rc rowCondition) matches(cvs Columns) (bool, error) {
+	text, known, err := columnText(cvs, rc.column)
+	if err != nil || !known {
+		return err == nil, err
+	}
+	switch rc.operator {
+	case "IS NULL":
+		return text == nil, nil
+	case "IS NOT NULL":
+		return text != nil, nil
+	}
+	if text == nil {
+		// comparing NULL is never true
+		return false, nil
+	}
+	cmp := strings.Compare(*text, rc.value)
+	if rc.numeric {
+		var ok bool
+		if cmp, ok = compareNumeric(*text, rc.value); !ok {
+			return false, nil
+		}
+	}
+	switch rc.operator {
+	case "=":
+		return cmp == 0, nil
+	case "<>", "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// compareNumeric compares the text representation of a numeric value with a numeric literal, with exact decimal
+// arithmetic (so that numeric and bigint values are compared without loss of precision).
+// Like in Postgres, NaN is larger than all other values. ok is false when the value is not a number.
+func compareNumeric(value string, literal string) (cmp int, ok bool) {
+	switch strings.ToLower(value) {
+	case "nan", "infinity":
+		return 1, true
+	case "-infinity":
+		return -1, true
+	}
+	v, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return 0, false
+	}
+	l, ok := new(big.Rat).SetString(literal)
+	if !ok {
+		return 0, false
+	}
+	return v.Cmp(l), true
+}
+
+// matches returns true if all conditions are true for these columns
+func (rf rowFilter) matches(cvs Columns) (bool, error) {
+	for _, condition := range rf {
+		if match, err := condition.matches(cvs); err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// tableIncluded returns true if changes of this table should be published (see include_tables and exclude_tables)
+func (c Config) tableIncluded(table Table) bool {
+	name := fmt.Sprintf("%s.%s", table.Namespace, table.TableName)
+	included := len(c.IncludeTables) == 0
+	for _, pattern := range c.IncludeTables {
+		if match, _ := path.Match(pattern, name); match {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range c.ExcludeTables {
+		if match, _ := path.Match(pattern, name); match {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRowFilter returns an error when the row filter of a table uses columns that are not part of its replica
+// identity. The old row of an UPDATE or DELETE only holds those columns, so it could not be matched, and an UPDATE of
+// a row that starts to match would not be published as an INSERT (which is why Postgres has the same restriction).
+func (c Config) checkRowFilter(rel *pglogrepl.RelationMessage) error {
+	filter, ok := c.rowFilters[fmt.Sprintf("%s.%s", rel.Namespace, rel.RelationName)]
+	if !ok || rel.ReplicaIdentity == 'f' {
+		return nil
+	}
+	keys := make(map[string]bool)
+	for _, col := range rel.Columns {
+		keys[col.Name] = col.Flags == 1
+	}
+	for _, condition := range filter {
+		if !keys[condition.column] {
+			return fmt.Errorf("row filter of %s.%s uses column %s, which is not part of the replica identity "+
+				"(set replica identity full, or only filter on key columns)", rel.Namespace, rel.RelationName,
+				condition.column)
+		}
+	}
+	return nil
+}
+
+// rowChange applies the row filter of its table (see row_filters) to a change, and returns the change that should be
+// published (and false if the change should be skipped). INSERT is matched on the new row, and DELETE on the old row
+// (or the key columns). Like row filters of Postgres publications, an UPDATE is matched on both: an UPDATE of a row
+// that no longer matches is published as a DELETE of the old row, and an UPDATE of a row that starts to match is
+// published as an INSERT of the new row.
+func (c Config) rowChange(t Transaction) (Transaction, bool, error) {
+	if len(t.Tables) != 1 {
+		return t, true, nil
+	}
+	filter, ok := c.rowFilters[fmt.Sprintf("%s.%s", t.Tables[0].Namespace, t.Tables[0].TableName)]
+	if !ok {
+		return t, true, nil
+	}
+	switch t.Type {
+	case "INSERT":
+		included, err := filter.matches(t.Values)
+		return t, included, err
+	case "DELETE":
+		included, err := filter.matches(t.Where)
+		return t, included, err
+	case "UPDATE":
+		oldMatch, err := filter.matches(t.Where)
+		if err != nil {
+			return t, false, err
+		}
+		newMatch, err := filter.matches(t.Values)
+		if err != nil || oldMatch == newMatch {
+			return t, newMatch, err
+		} else if oldMatch {
+			return Transaction{LSN: t.LSN, Xid: t.Xid, Type: "DELETE", Tables: t.Tables, Where: t.Where,
+				FullIdentity: t.FullIdentity}, true, nil
+		}
+		values := make(Columns)
+		for name, col := range t.Values {
+			if !col.Data.Changed() {
+				// unchanged TOAST values are only known when the old row holds them (replica identity full)
+				if old, exists := t.Where[name]; exists && old.Data.Changed() {
+					col = old
+				} else {
+					continue
+				}
+			}
+			values[name] = col
+		}
+		return Transaction{LSN: t.LSN, Xid: t.Xid, Type: "INSERT", Tables: t.Tables, Values: values}, true, nil
+	}
+	return t, true, nil
+}
+
+// rowFilterSql returns the row filter of a table as a where clause (or an empty string without row filter)
+func (c Config) rowFilterSql(table Table) string {
+	if predicate, ok := c.RowFilters[fmt.Sprintf("%s.%s", table.Namespace, table.TableName)]; ok {
+		return fmt.Sprintf(" WHERE %s", predicate)
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+package pg
+
+import (
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+func TestParseRowFilter(t *testing.T) {
+	for _, test := range []struct {
+		predicate string
+		expected  rowFilter
+		invalid   bool
+	}{
+		{predicate: "region = 'EU'", expected: rowFilter{{column: "region", operator: "=", value: "EU"}}},
+		{predicate: `"Region" <> 'it''s'`, expected: rowFilter{{column: "Region", operator: "<>", value: "it's"}}},
+		{predicate: "Amount >= -1.5 and deleted_at is  null", expected: rowFilter{
+			{column: "amount", operator: ">=", value: "-1.5", numeric: true},
+			{column: "deleted_at", operator: "IS NULL"},
+		}},
+		{predicate: "deleted_at IS NOT NULL", expected: rowFilter{{column: "deleted_at", operator: "IS NOT NULL"}}},
+		{predicate: "", invalid: true},
+		{predicate: "region > 'EU'", invalid: true},
+		{predicate: "region = ", invalid: true},
+		{predicate: "deleted_at IS NULL 1", invalid: true},
+		{predicate: "region = 'EU' OR region = 'US'", invalid: true},
+	} {
+		filter, err := parseRowFilter(test.predicate)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseRowFilter(%q): expected an error, got %v", test.predicate, filter)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("parseRowFilter(%q): unexpected error: %v", test.predicate, err)
+			continue
+		}
+		if len(filter) != len(test.expected) {
+			t.Errorf("parseRowFilter(%q): expected %v, got %v", test.predicate, test.expected, filter)
+			continue
+		}
+		for i, condition := range filter {
+			if condition != test.expected[i] {
+				t.Errorf("parseRowFilter(%q): expected condition %v, got %v", test.predicate, test.expected[i],
+					condition)
+			}
+		}
+	}
+}
+
+func TestRowConditionMatches(t *testing.T) {
+	cvs := textColumns(map[string]*string{
+		"region":     strPtr("EU"),
+		"amount":     strPtr("10.50"),
+		"big":        strPtr("12345678901234567890"),
+		"nan":        strPtr("NaN"),
+		"deleted_at": nil,
+	})
+	cvs["toasted"] = Column{Meta: MetaData{Name: "toasted"}, Data: Data{Type: 'u'}}
+	for _, test := range []struct {
+		predicate string
+		expected  bool
+	}{
+		{"region = 'EU'", true},
+		{"region = 'eu'", false},
+		{"region <> 'US'", true},
+		{"region != 'EU'", false},
+		{"amount = 10.5", true},
+		{"amount > 10", true},
+		{"amount < 10.5", false},
+		{"amount <= 10.5", true},
+		{"amount >= 11", false},
+		{"big > 12345678901234567889", true},
+		{"big = 12345678901234567890", true},
+		{"nan > 1000", true},
+		{"region > 1", false},
+		{"deleted_at IS NULL", true},
+		{"deleted_at IS NOT NULL", false},
+		{"deleted_at = 'x'", false},
+		{"deleted_at <> 'x'", false},
+		{"region IS NOT NULL", true},
+		// unknown values (missing columns and unchanged TOAST values) are assumed to match
+		{"missing = 'x'", true},
+		{"toasted = 'x'", true},
+		{"region = 'EU' AND amount > 100", false},
+		{"region = 'EU' AND deleted_at IS NULL", true},
+	} {
+		filter, err := parseRowFilter(test.predicate)
+		if err != nil {
+			t.Fatalf("parseRowFilter(%q): unexpected error: %v", test.predicate, err)
+		}
+		if match, err := filter.matches(cvs); err != nil {
+			t.Errorf("%q: unexpected error: %v", test.predicate, err)
+		} else if match != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.predicate, test.expected, match)
+		}
+	}
+}
+
+func TestRowChange(t *testing.T) {
+	filter, err := parseRowFilter("region = 'EU'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{rowFilters: map[string]rowFilter{"public.orders": filter}}
+	orders := Tables{{Namespace: "public", TableName: "orders"}}
+	eu := textColumns(map[string]*string{"id": strPtr("1"), "region": strPtr("EU")})
+	us := textColumns(map[string]*string{"id": strPtr("1"), "region": strPtr("US")})
+	for _, test := range []struct {
+		name     string
+		change   Transaction
+		included bool
+		typ      string
+	}{
+		{"insert match", Transaction{Type: "INSERT", Tables: orders, Values: eu}, true, "INSERT"},
+		{"insert no match", Transaction{Type: "INSERT", Tables: orders, Values: us}, false, "INSERT"},
+		{"delete match", Transaction{Type: "DELETE", Tables: orders, Where: eu}, true, "DELETE"},
+		{"delete no match", Transaction{Type: "DELETE", Tables: orders, Where: us}, false, "DELETE"},
+		{"update stays in", Transaction{Type: "UPDATE", Tables: orders, Where: eu, Values: eu}, true, "UPDATE"},
+		{"update stays out", Transaction{Type: "UPDATE", Tables: orders, Where: us, Values: us}, false, "UPDATE"},
+		{"update moves out", Transaction{Type: "UPDATE", Tables: orders, Where: eu, Values: us}, true, "DELETE"},
+		{"update moves in", Transaction{Type: "UPDATE", Tables: orders, Where: us, Values: eu}, true, "INSERT"},
+		{"other table", Transaction{Type: "INSERT", Tables: Tables{{Namespace: "public", TableName: "other"}},
+			Values: us}, true, "INSERT"},
+	} {
+		change, included, err := c.rowChange(test.change)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if included != test.included {
+			t.Errorf("%s: expected included %v, got %v", test.name, test.included, included)
+		} else if change.Type != test.typ {
+			t.Errorf("%s: expected type %s, got %s", test.name, test.typ, change.Type)
+		}
+	}
+}
+
+func TestCheckRowFilter(t *testing.T) {
+	filter, err := parseRowFilter("region = 'EU'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{rowFilters: map[string]rowFilter{"public.orders": filter}}
+	relation := func(identity uint8, keys ...string) *pglogrepl.RelationMessage {
+		rel := &pglogrepl.RelationMessage{Namespace: "public", RelationName: "orders", ReplicaIdentity: identity}
+		for _, name := range []string{"id", "region"} {
+			col := &pglogrepl.RelationMessageColumn{Name: name}
+			for _, key := range keys {
+				if key == name {
+					col.Flags = 1
+				}
+			}
+			rel.Columns = append(rel.Columns, col)
+		}
+		return rel
+	}
+	for _, test := range []struct {
+		name  string
+		rel   *pglogrepl.RelationMessage
+		valid bool
+	}{
+		{"filter on non-key column", relation('d', "id"), false},
+		{"filter on key column", relation('i', "id", "region"), true},
+		{"replica identity full", relation('f', "id", "region"), true},
+		{"table without row filter", &pglogrepl.RelationMessage{Namespace: "public", RelationName: "other",
+			ReplicaIdentity: 'd'}, true},
+	} {
+		if err := c.checkRowFilter(test.rel); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package pg
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
@@ -63,7 +65,65 @@ func decodeTextColumnData(data []byte, dataType uint32) (interface{}, error) {
 	return string(data), nil
 }
 
+// hasBinaryCodec returns true if binaryToText can convert values of a type
+func hasBinaryCodec(dataType uint32, typeName string) bool {
+	if typeMap == nil {
+		typeMap = pgtype.NewMap()
+	}
+	switch typeName {
+	case "json", "xml", "jsonb":
+		return true
+	}
+	_, ok := typeMap.TypeForOID(dataType)
+	return ok
+}
+
+// binaryToText converts a value in binary format (as sent by pgoutput with binary enabled) into its text
+// representation, using the pgtype binary codecs. Unlike decodeTextColumnData and Column.Sql for text values,
+// this does not go through Go floats or truncated timestamps, so the value is converted without loss of precision.
+// Types without a codec (e.a. extension and user defined types) return an error, since their binary format is unknown.
+func binaryToText(data []byte, dataType uint32, typeName string) (string, error) {
+	if typeMap == nil {
+		typeMap = pgtype.NewMap()
+	}
+	switch typeName {
+	case "json", "xml":
+		// the binary format is the text representation
+		return string(data), nil
+	case "jsonb":
+		// the binary format is a version byte followed by the text representation
+		if len(data) == 0 || data[0] != 1 {
+			return "", fmt.Errorf("unsupported jsonb binary format")
+		}
+		return string(data[1:]), nil
+	}
+	dt, ok := typeMap.TypeForOID(dataType)
+	if !ok {
+		return "", fmt.Errorf("no binary codec for type %s (oid %d)", typeName, dataType)
+	}
+	value, err := dt.Codec.DecodeValue(typeMap, dataType, pgtype.BinaryFormatCode, data)
+	if err != nil {
+		return "", err
+	}
+	text, err := typeMap.Encode(dataType, pgtype.TextFormatCode, value, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
 // connectStringValue uses proper quoting for connect string values
 func connectStringValue(objectName string) (escaped string) {
 	return fmt.Sprintf("'%s'", strings.Replace(objectName, "'", "\\'", -1))
 }
+
+// serverMajorVersion returns the major version (e.a. 9 for 9.6.3 and 16 for 16.2) of the connected server
+func serverMajorVersion(conn *pgconn.PgConn) (int, error) {
+	version := conn.ParameterStatus("server_version")
+	major := strings.SplitN(strings.SplitN(version, " ", 2)[0], ".", 2)[0]
+	if v, err := strconv.Atoi(major); err != nil {
+		return 0, fmt.Errorf("could not derive major version from server_version %s: %w", version, err)
+	} else {
+		return v, nil
+	}
+}
@@ -0,0 +1,58 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestBinaryToText(t *testing.T) {
+	for _, test := range []struct {
+		data     []byte
+		oid      uint32
+		typeName string
+		expected string
+		invalid  bool
+	}{
+		{data: []byte{1}, oid: 16, typeName: "bool", expected: "t"},
+		{data: []byte{0xff, 0xff, 0xff, 0xfe}, oid: 23, typeName: "int4", expected: "-2"},
+		{data: []byte{0, 0, 0, 0, 0, 0, 0x30, 0x39}, oid: 20, typeName: "int8", expected: "12345"},
+		{data: []byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, oid: 701, typeName: "float8", expected: "1.5"},
+		{data: []byte("héllo"), oid: 25, typeName: "text", expected: "héllo"},
+		// numeric 12345.678: 3 digits (1, 2345, 6780), weight 1, positive, scale 3
+		{data: []byte{0, 3, 0, 1, 0, 0, 0, 3, 0, 1, 0x09, 0x29, 0x1a, 0x7c}, oid: 1700, typeName: "numeric",
+			expected: "12345.678"},
+		{data: []byte(`{"a": 1}`), oid: 114, typeName: "json", expected: `{"a": 1}`},
+		{data: append([]byte{1}, []byte(`{"a": 1}`)...), oid: 3802, typeName: "jsonb", expected: `{"a": 1}`},
+		{data: append([]byte{2}, []byte(`{"a": 1}`)...), oid: 3802, typeName: "jsonb", invalid: true},
+		{data: []byte{1, 2, 3}, oid: 23, typeName: "int4", invalid: true},
+		{data: []byte{1, 2, 3}, oid: 99999, typeName: "hstore", invalid: true},
+	} {
+		text, err := binaryToText(test.data, test.oid, test.typeName)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("binaryToText(%v, %s): expected an error, got %q", test.data, test.typeName, text)
+			}
+		} else if err != nil {
+			t.Errorf("binaryToText(%v, %s): unexpected error: %v", test.data, test.typeName, err)
+		} else if text != test.expected {
+			t.Errorf("binaryToText(%v, %s): expected %q, got %q", test.data, test.typeName, test.expected, text)
+		}
+	}
+}
+
+func TestHasBinaryCodec(t *testing.T) {
+	for _, test := range []struct {
+		oid      uint32
+		typeName string
+		expected bool
+	}{
+		{23, "int4", true},
+		{1700, "numeric", true},
+		{3802, "jsonb", true},
+		{99999, "jsonb", true},
+		{99999, "hstore", false},
+	} {
+		if ok := hasBinaryCodec(test.oid, test.typeName); ok != test.expected {
+			t.Errorf("hasBinaryCodec(%d, %s): expected %v, got %v", test.oid, test.typeName, test.expected, ok)
+		}
+	}
+}
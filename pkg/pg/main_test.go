@@ -0,0 +1,30 @@
+package pg
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	InitLogger(zap.NewNop().Sugar())
+	os.Exit(m.Run())
+}
+
+// textColumns returns columns with text values (and NULL for nil values)
+func textColumns(values map[string]*string) Columns {
+	cvs := make(Columns)
+	for name, value := range values {
+		col := Column{Meta: MetaData{Name: name, TypeOID: 25, TypeName: "text"}, Data: Data{Type: 'n'}}
+		if value != nil {
+			col.Data = Data{Type: 't', Length: uint32(len(*value)), Data: []byte(*value)}
+		}
+		cvs[name] = col
+	}
+	return cvs
+}
+
+func strPtr(s string) *string {
+	return &s
+}
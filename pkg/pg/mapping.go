@@ -0,0 +1,115 @@
+package pg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ColumnMaps holds the column renames (source name to destination name) per table (as schema.table)
+type ColumnMaps map[string]map[string]string
+
+func (cm ColumnMaps) Clone() ColumnMaps {
+	clone := make(ColumnMaps)
+	for table, columns := range cm {
+		clone[table] = make(map[string]string)
+		for source, destination := range columns {
+			clone[table][source] = destination
+		}
+	}
+	return clone
+}
+
+// tableMapping is a table_map entry that is matched as a regular expression
+type tableMapping struct {
+	re     *regexp.Regexp
+	target string
+}
+
+// parseTableMappings compiles all table_map entries (in sorted order) as regular expressions, which need to match
+// the complete schema.table name of the source
+func parseTableMappings(tableMap map[string]string) (mappings []tableMapping, err error) {
+	var patterns []string
+	for pattern := range tableMap {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		re, reErr := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+		if reErr != nil {
+			return nil, fmt.Errorf("invalid table_map pattern %s: %w", pattern, reErr)
+		}
+		mappings = append(mappings, tableMapping{re: re, target: tableMap[pattern]})
+	}
+	return mappings, nil
+}
+
+// mapTable returns the destination table for a source table (see schema_map and table_map).
+// A table_map target without a schema only renames the table, and the schema is still mapped with schema_map.
+func (c Config) mapTable(table Table) Table {
+	name := fmt.Sprintf("%s.%s", table.Namespace, table.TableName)
+	target, mapped := c.TableMap[name]
+	if !mapped {
+		for _, mapping := range c.tableMappings {
+			if mapping.re.MatchString(name) {
+				target, mapped = mapping.re.ReplaceAllString(name, mapping.target), true
+				break
+			}
+		}
+	}
+	if mapped {
+		if schema, tableName, hasSchema := strings.Cut(target, "."); hasSchema {
+			return Table{Namespace: schema, TableName: tableName}
+		}
+		table.TableName = target
+	}
+	if schema, ok := c.SchemaMap[table.Namespace]; ok {
+		table.Namespace = schema
+	}
+	return table
+}
+
+// mapColumns returns the columns with the destination names (see column_map) of a source table
+func (c Config) mapColumns(renames map[string]string, cvs Columns) Columns {
+	if len(renames) == 0 || cvs == nil {
+		return cvs
+	}
+	mapped := make(Columns)
+	for name, col := range cvs {
+		if destination, ok := renames[name]; ok {
+			name, col.Meta.Name = destination, destination
+		}
+		mapped[name] = col
+	}
+	return mapped
+}
+
+// mapChange maps the tables and columns of a change from the source to the destination.
+// Column renames are defined for the source table. Captured DDL statements are applied as is.
+func (c Config) mapChange(t Transaction) Transaction {
+	if len(c.SchemaMap) == 0 && len(c.TableMap) == 0 && len(c.ColumnMap) == 0 {
+		return t
+	}
+	if len(t.Tables) == 1 {
+		renames := c.ColumnMap[fmt.Sprintf("%s.%s", t.Tables[0].Namespace, t.Tables[0].TableName)]
+		t.Values = c.mapColumns(renames, t.Values)
+		t.Where = c.mapColumns(renames, t.Where)
+		if t.Relation != nil && len(renames) > 0 {
+			relation := Relation{ReplicaIdentity: t.Relation.ReplicaIdentity}
+			for _, col := range t.Relation.Columns {
+				if destination, ok := renames[col.Name]; ok {
+					col.Name = destination
+				}
+				relation.Columns = append(relation.Columns, col)
+			}
+			t.Relation = &relation
+		}
+	}
+	var tables Tables
+	for _, table := range t.Tables {
+		tables = append(tables, c.mapTable(table))
+	}
+	t.Tables = tables
+	return t
+}
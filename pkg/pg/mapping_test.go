@@ -0,0 +1,48 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestMapTable(t *testing.T) {
+	tableMap := map[string]string{
+		"public.orders":   "sales.orders_v2",
+		"public.t_(.*)":   "$1",
+		"legacy\\.(.*)":   "archive.old_$1",
+		"public.customer": "clients",
+	}
+	mappings, err := parseTableMappings(tableMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{TableMap: tableMap, SchemaMap: map[string]string{"public": "app"}, tableMappings: mappings}
+	for _, test := range []struct {
+		source   Table
+		expected Table
+	}{
+		{Table{Namespace: "public", TableName: "orders"}, Table{Namespace: "sales", TableName: "orders_v2"}},
+		{Table{Namespace: "public", TableName: "customer"}, Table{Namespace: "app", TableName: "clients"}},
+		{Table{Namespace: "public", TableName: "t_items"}, Table{Namespace: "app", TableName: "items"}},
+		{Table{Namespace: "legacy", TableName: "users"}, Table{Namespace: "archive", TableName: "old_users"}},
+		{Table{Namespace: "public", TableName: "other"}, Table{Namespace: "app", TableName: "other"}},
+		{Table{Namespace: "other", TableName: "t_items"}, Table{Namespace: "other", TableName: "t_items"}},
+	} {
+		if mapped := c.mapTable(test.source); mapped != test.expected {
+			t.Errorf("mapTable(%v): expected %v, got %v", test.source, test.expected, mapped)
+		}
+	}
+}
+
+func TestParseTableMappings(t *testing.T) {
+	if _, err := parseTableMappings(map[string]string{"public.(": "x"}); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+	// the pattern needs to match the complete name
+	mappings, err := parseTableMappings(map[string]string{"public.t": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mappings[0].re.MatchString("public.t_items") {
+		t.Errorf("expected pattern to be anchored")
+	}
+}
@@ -0,0 +1,54 @@
+package pg
+
+import (
+	"fmt"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// LogicalMessage holds the info of a logical decoding message (as emitted with pg_logical_emit_message)
+type LogicalMessage struct {
+	Prefix        string
+	Transactional bool
+	Content       []byte
+}
+
+// messageTable returns the table that logical decoding messages are inserted into on the destination.
+// It returns an empty string when no message_table is configured, which means that messages are ignored.
+func (c *Conn) messageTable() (string, error) {
+	if c.config.MessageTable == "" {
+		return "", nil
+	}
+	table := identifierNameSql(c.config.MessageTable)
+	if c.messageTableCreated {
+		return table, nil
+	}
+	if err := c.RunSQL(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (lsn pg_lsn NOT NULL, xid bigint NOT NULL, "+
+		"prefix text NOT NULL, transactional bool NOT NULL, content bytea, "+
+		"received timestamptz NOT NULL DEFAULT now())", table)); err != nil {
+		return "", err
+	}
+	c.messageTableCreated = true
+	return table, nil
+}
+
+// messageStatements returns the statements that handle a logical decoding message on the destination
+func (c *Conn) messageStatements(t Transaction) ([]string, error) {
+	if !c.config.handlesMessagePrefix(t.Message.Prefix) {
+		log.Debugf("ignoring logical decoding message with prefix %s", t.Message.Prefix)
+		return nil, nil
+	}
+	table, err := c.messageTable()
+	if err != nil || table == "" {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("INSERT INTO %s (lsn, xid, prefix, transactional, content) "+
+		"VALUES ('%s', %d, %s, %t, '\\x%x'::bytea)",
+		table,
+		pglogrepl.LSN(t.LSN),
+		t.Xid,
+		stringValueSql(t.Message.Prefix),
+		t.Message.Transactional,
+		t.Message.Content,
+	)}, nil
+}
@@ -0,0 +1,43 @@
+package pg
+
+import (
+	"fmt"
+)
+
+// filterOrigin returns true if transactions with a replication origin should be filtered by pgarrow.
+// On Postgres 16 and newer this is done by pgoutput (origin none).
+func (c *Conn) filterOrigin() bool {
+	return c.config.Origin == "none" && c.serverVersion < 16
+}
+
+// setOrigin marks the source transaction that is being received with its replication origin.
+// Since only the first chunk of a streamed transaction has an origin message, the xid is remembered
+// for the next chunks.
+func (c *Conn) setOrigin(origin string) {
+	if c.current == nil {
+		log.Fatalf("received ORIGIN %s outside of a transaction", origin)
+	}
+	c.current.Origin = origin
+	if c.current.Type == "STREAM" && c.filterOrigin() {
+		c.originXids[c.current.Xid] = origin
+	}
+}
+
+// setupOrigin sets up the replication origin (see replication_origin) for the apply session,
+// so that applied changes can be recognized (and filtered) when they are decoded on this database.
+func (c *Conn) setupOrigin() (err error) {
+	if c.config.ApplyOrigin == "" || c.originSetUp {
+		return nil
+	}
+	origin := stringValueSql(c.config.ApplyOrigin)
+	if err = c.exec(fmt.Sprintf("SELECT pg_replication_origin_create(%s) WHERE NOT EXISTS "+
+		"(SELECT FROM pg_replication_origin WHERE roname = %s)", origin, origin)); err != nil {
+		return err
+	}
+	if err = c.exec(fmt.Sprintf("SELECT pg_replication_origin_session_setup(%s)", origin)); err != nil {
+		return err
+	}
+	log.Infof("applying changes with replication origin %s", c.config.ApplyOrigin)
+	c.originSetUp = true
+	return nil
+}
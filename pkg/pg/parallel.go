@@ -0,0 +1,187 @@
+package pg
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// keyHash returns a hash of the table and the key columns of a row
+func keyHash(table Table, key Columns) uint32 {
+	var parts []string
+	for name, col := range key {
+		parts = append(parts, fmt.Sprintf("%s=%x", name, col.Data.Data))
+	}
+	sort.Strings(parts)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(table.RelationName()))
+	_, _ = h.Write([]byte(strings.Join(parts, ",")))
+	return h.Sum32()
+}
+
+// keyColumns returns the key columns of the values of a change (as flagged by the source)
+func keyColumns(values Columns) Columns {
+	key := make(Columns)
+	for name, col := range values {
+		if col.Meta.Flags == 1 && col.Data.Changed() {
+			key[name] = col
+		}
+	}
+	return key
+}
+
+// worker returns the worker that should apply an envelope (based on a hash of the table and key of every change),
+// or false when the envelope needs to be applied as a barrier: when it has changes of rows that belong to
+// different workers, changes of rows without a key (e.a. replica identity full or nothing),
+// or changes that are not an INSERT, UPDATE or DELETE (e.a. TRUNCATE or DDL).
+func (t Transaction) worker(workers int) (worker int, ok bool) {
+	worker = -1
+	for _, change := range t.Changes {
+		if change.FullIdentity {
+			return 0, false
+		}
+		var keys []Columns
+		switch change.Type {
+		case "INSERT":
+			keys = append(keys, keyColumns(change.Values))
+		case "UPDATE":
+			keys = append(keys, keyColumns(change.Values), change.Where)
+		case "DELETE":
+			keys = append(keys, change.Where)
+		default:
+			return 0, false
+		}
+		for _, key := range keys {
+			if len(key) == 0 {
+				return 0, false
+			}
+			w := int(keyHash(change.Tables[0], key) % uint32(workers))
+			if worker >= 0 && w != worker {
+				return 0, false
+			}
+			worker = w
+		}
+	}
+	return worker, worker >= 0
+}
+
+// applyWorkers returns the connections of the workers that apply envelopes in parallel (see apply_workers).
+// Every worker keeps its own progress (and uses its own replication origin).
+func (c *Conn) applyWorkers() []*Conn {
+	if len(c.workers) > 0 {
+		return c.workers
+	}
+	for i := 0; i < c.config.ApplyWorkers; i++ {
+		workerConfig := c.config.Clone()
+		workerConfig.SkipErrors = c.config.SkipErrors
+		workerConfig.Pipeline = fmt.Sprintf("%s/%d", c.config.Pipeline, i)
+		if c.config.ApplyOrigin != "" {
+			workerConfig.ApplyOrigin = fmt.Sprintf("%s_%d", c.config.ApplyOrigin, i)
+		}
+		worker := NewConn(&workerConfig)
+		worker.deadLetterPublisher = c.deadLetterPublisher
+		c.workers = append(c.workers, worker)
+	}
+	return c.workers
+}
+
+// processParallel applies messages with a pool of workers. Envelopes are dispatched by a hash of table and key,
+// which keeps the order of changes of every row. Envelopes that cannot be dispatched (and streamed and
+// prepared transactions) are barriers: all workers finish before they are applied (in order).
+func (c *Conn) processParallel(msgs [][]byte) (err error) {
+	var segment Transactions
+	for _, msg := range msgs {
+		t, tErr := TransactionFromBytes(msg)
+		if tErr != nil {
+			if err = c.failed(msg, Transaction{}, tErr); err != nil {
+				return err
+			}
+			continue
+		}
+		if applied, aErr := c.applied(t); aErr != nil {
+			return aErr
+		} else if applied {
+			log.Infof("skipping %s (xid %d, lsn %s), which is already applied", t.Type, t.Xid, t.Position())
+			continue
+		}
+		if _, ok := t.worker(c.config.ApplyWorkers); ok && t.Type == "COMMIT" {
+			segment = append(segment, t)
+			continue
+		}
+		if err = c.applySegment(segment); err != nil {
+			return err
+		}
+		segment = nil
+		if err = c.ProcessMsg(msg); err != nil {
+			return err
+		}
+	}
+	return c.applySegment(segment)
+}
+
+// applySegment applies envelopes with the workers (every worker applies its envelopes in one transaction),
+// waits for all of them to finish, and then stores the progress of the segment as a whole
+func (c *Conn) applySegment(segment Transactions) error {
+	if len(segment) == 0 {
+		return nil
+	}
+	// helper tables are created up front (every worker checks them again before its transaction), since concurrent
+	// CREATE TABLE IF NOT EXISTS statements can fail when the table does not exist yet
+	if err := c.helperTables(); err != nil {
+		return err
+	}
+	workers := c.applyWorkers()
+	perWorker := make([]Transactions, len(workers))
+	var last Transaction
+	for _, t := range segment {
+		w, _ := t.worker(len(workers))
+		perWorker[w] = append(perWorker[w], t)
+		if t.Position() > last.Position() {
+			last = t
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(workers))
+	for i, envelopes := range perWorker {
+		if len(envelopes) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(worker *Conn, envelopes Transactions, i int) {
+			defer wg.Done()
+			var todo Transactions
+			for _, t := range envelopes {
+				// after a crash, the worker could already have applied some of the envelopes of the segment
+				if applied, aErr := worker.applied(t); aErr != nil {
+					errs[i] = aErr
+					return
+				} else if !applied {
+					todo = append(todo, t)
+				}
+			}
+			errs[i] = worker.applyEnvelopes(todo)
+		}(workers[i], envelopes, i)
+	}
+	wg.Wait()
+	for i, wErr := range errs {
+		if wErr == nil {
+			continue
+		} else if !c.config.handlesFailures() || !c.config.permanentError(wErr) {
+			return fmt.Errorf("worker %d: %w", i, wErr)
+		}
+		// the transaction of this worker is rolled back, so that only the envelope that fails is handled
+		if err := workers[i].applyEach(perWorker[i]); err != nil {
+			return fmt.Errorf("worker %d: %w", i, err)
+		}
+	}
+	log.Debugf("applied %d transactions with %d workers", len(segment), len(workers))
+	if err := c.setProgress(last); err != nil {
+		return err
+	}
+	if position := last.Position(); position > c.progressLSN {
+		c.progressLSN = position
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package pg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeyHash(t *testing.T) {
+	orders := Table{Namespace: "public", TableName: "orders"}
+	items := Table{Namespace: "public", TableName: "items"}
+	key := textColumns(map[string]*string{"id": strPtr("1"), "line": strPtr("2")})
+	if keyHash(orders, key) != keyHash(orders, textColumns(map[string]*string{"line": strPtr("2"),
+		"id": strPtr("1")})) {
+		t.Errorf("expected the same hash for the same key")
+	}
+	if keyHash(orders, key) == keyHash(items, key) {
+		t.Errorf("expected a different hash for another table")
+	}
+	if keyHash(orders, key) == keyHash(orders, textColumns(map[string]*string{"id": strPtr("1"),
+		"line": strPtr("3")})) {
+		t.Errorf("expected a different hash for another key")
+	}
+}
+
+func TestTransactionWorker(t *testing.T) {
+	const workers = 4
+	orders := Tables{{Namespace: "public", TableName: "orders"}}
+	// row returns the values of a row, with id as key column
+	row := func(id int) Columns {
+		values := textColumns(map[string]*string{"id": strPtr(fmt.Sprint(id)), "note": strPtr("x")})
+		key := values["id"]
+		key.Meta.Flags = 1
+		values["id"] = key
+		return values
+	}
+	where := func(id int) Columns {
+		return textColumns(map[string]*string{"id": strPtr(fmt.Sprint(id))})
+	}
+	// find two rows that belong to different workers
+	first := Transaction{Type: "COMMIT", Changes: Transactions{{Type: "INSERT", Tables: orders, Values: row(1)}}}
+	firstWorker, ok := first.worker(workers)
+	if !ok {
+		t.Fatalf("expected an INSERT with a key to have a worker")
+	}
+	other := 2
+	for ; ; other++ {
+		if w, _ := (Transaction{Type: "COMMIT", Changes: Transactions{{Type: "INSERT", Tables: orders,
+			Values: row(other)}}}).worker(workers); w != firstWorker {
+			break
+		}
+	}
+	for _, test := range []struct {
+		name    string
+		changes Transactions
+		ok      bool
+	}{
+		{"changes of one row", Transactions{
+			{Type: "INSERT", Tables: orders, Values: row(1)},
+			{Type: "UPDATE", Tables: orders, Values: row(1), Where: where(1)},
+			{Type: "DELETE", Tables: orders, Where: where(1)},
+		}, true},
+		{"rows of different workers", Transactions{
+			{Type: "INSERT", Tables: orders, Values: row(1)},
+			{Type: "INSERT", Tables: orders, Values: row(other)},
+		}, false},
+		{"update of the key", Transactions{{Type: "UPDATE", Tables: orders, Values: row(other), Where: where(1)}},
+			false},
+		{"replica identity full", Transactions{{Type: "DELETE", Tables: orders, Where: where(1),
+			FullIdentity: true}}, false},
+		{"row without key", Transactions{{Type: "INSERT", Tables: orders, Values: where(1)}}, false},
+		{"truncate", Transactions{{Type: "TRUNCATE", Tables: orders}}, false},
+		{"without changes", nil, false},
+	} {
+		worker, ok := Transaction{Type: "COMMIT", Changes: test.changes}.worker(workers)
+		if ok != test.ok {
+			t.Errorf("%s: expected ok %v, got %v", test.name, test.ok, ok)
+		} else if ok && worker != firstWorker {
+			t.Errorf("%s: expected worker %d, got %d", test.name, firstWorker, worker)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package pg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// firstNormalObjectId is the first oid that is assigned to user defined objects (like enums and domains).
+// Oids of built-in types are equal on the source and the destination.
+const firstNormalObjectId = 16384
+
+// statement is a statement with parameters ($1, $2, ...) for column values. The parameters are bound with the
+// original (text or binary) values from the WAL and their type oids, instead of being formatted as SQL literals.
+type statement struct {
+	sql    string
+	params []Column
+}
+
+// param adds a parameter for the value of a column, and returns its placeholder
+func (s *statement) param(col Column) string {
+	s.params = append(s.params, col)
+	return fmt.Sprintf("$%d", len(s.params))
+}
+
+// where returns the where clause for columns, with parameters for the values (see Columns.WhereSQL)
+func (s *statement) where(where Columns, nullSafe bool) string {
+	operator := "="
+	if nullSafe {
+		operator = "IS NOT DISTINCT FROM"
+	}
+	var parts []string
+	for _, name := range where.changedNames() {
+		parts = append(parts, fmt.Sprintf("%s %s %s", identifierNameSql(name), operator, s.param(where[name])))
+	}
+	if len(parts) == 0 {
+		log.Fatal("Seems we are about to run a query without WHERE statement!!!")
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// localOlder returns a condition that is true for rows that were last changed on the destination before the
+// source transaction committed (or when the commit timestamp is unknown). This requires track_commit_timestamp.
+func (s *statement) localOlder(envelope Transaction) string {
+	return fmt.Sprintf("coalesce(pg_xact_commit_timestamp(xmin) <= %s, true)", s.param(Column{
+		Data: Data{Type: 't', Data: []byte(envelope.CommitTime.Format(time.RFC3339Nano))},
+		Meta: MetaData{Name: "commit_time", TypeOID: 1184, TypeName: "timestamptz"},
+	}))
+}
+
+// changedNames returns the (sorted) names of all columns that have a value, so that statements for the same
+// set of columns are equal
+func (cvs Columns) changedNames() (names []string) {
+	for name, col := range cvs {
+		if col.Data.Changed() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// insertStatement returns an INSERT statement for a row
+func insertStatement(table Table, values Columns) (s statement) {
+	var names, placeholders []string
+	for _, name := range values.changedNames() {
+		names = append(names, identifierNameSql(name))
+		placeholders = append(placeholders, s.param(values[name]))
+	}
+	if len(names) == 0 {
+		log.Fatal("Seems we are about to run an INSERT query with an empty value list!!!")
+	}
+	s.sql = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table.RelationName(), strings.Join(names, ","),
+		strings.Join(placeholders, ","))
+	return s
+}
+
+// updateStatement returns an UPDATE statement that sets the values of the rows that match where
+func updateStatement(table Table, values Columns, where Columns, nullSafe bool) (s statement) {
+	var parts []string
+	for _, name := range values.changedNames() {
+		parts = append(parts, fmt.Sprintf("%s = %s", identifierNameSql(name), s.param(values[name])))
+	}
+	if len(parts) == 0 {
+		log.Fatal("Seems we are about to run an update query with an empty SET statement!!!")
+	}
+	s.sql = fmt.Sprintf("UPDATE %s SET %s", table.RelationName(), strings.Join(parts, ", "))
+	s.sql = fmt.Sprintf("%s WHERE %s", s.sql, s.where(where, nullSafe))
+	return s
+}
+
+// changeStatement returns the statement that applies an INSERT, UPDATE or DELETE change
+func changeStatement(change Transaction) (s statement) {
+	switch change.Type {
+	case "INSERT":
+		return insertStatement(change.Tables[0], change.Values)
+	case "UPDATE":
+		return updateStatement(change.Tables[0], change.Values, change.Where, change.FullIdentity)
+	case "DELETE":
+		s.sql = fmt.Sprintf("DELETE FROM %s WHERE %s", change.Tables[0].RelationName(),
+			s.where(change.Where, change.FullIdentity))
+		return s
+	}
+	log.Panicf("cannot create a statement for a %s change", change.Type)
+	return s
+}
+
+// bind returns the values, formats and type oids of the parameters. Values of user defined types are bound without
+// a type oid (since the oid differs between source and destination), which means that the type is inferred.
+func (s statement) bind() (values [][]byte, formats []int16, oids []uint32) {
+	for _, col := range s.params {
+		var value []byte
+		var format int16
+		switch col.Data.Type {
+		case 'n':
+		case 'b':
+			value, format = col.Data.Data, 1
+		default:
+			value = col.Data.Data
+			if value == nil {
+				// a NULL parameter is a nil value, so an empty text value should not be nil
+				value = []byte{}
+			}
+		}
+		oid := col.Meta.TypeOID
+		if oid >= firstNormalObjectId {
+			oid = 0
+		}
+		values = append(values, value)
+		formats = append(formats, format)
+		oids = append(oids, oid)
+	}
+	return values, formats, oids
+}
+
+// execStatement runs a statement as a prepared statement on the apply connection, and returns the number of rows
+// that were affected. Statements are prepared once per connection, and cached by their SQL and parameter types.
+func (c *Conn) execStatement(s statement) (int64, error) {
+	values, formats, oids := s.bind()
+	key := fmt.Sprintf("%s %v", s.sql, oids)
+	name, ok := c.prepared[key]
+	if !ok {
+		name = fmt.Sprintf("pgarrow_%d", len(c.prepared)+1)
+		log.Debugf("Preparing %s: %s", name, s.sql)
+		if _, err := c.aConn.Prepare(ctx, name, s.sql, oids); err != nil {
+			return 0, err
+		}
+		c.prepared[key] = name
+	}
+	log.Debugf("Running %s: %s", name, s.sql)
+	tag, err := c.aConn.ExecPrepared(ctx, name, values, formats, nil).Close()
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// queryStatement runs a query with parameters on the apply connection, and returns all rows (as text)
+func (c *Conn) queryStatement(s statement) (answer []map[string]string, err error) {
+	values, formats, oids := s.bind()
+	log.Debugf("Running SQL: %s", s.sql)
+	result := c.aConn.ExecParams(ctx, s.sql, values, oids, formats, nil)
+	fields := result.FieldDescriptions()
+	for result.NextRow() {
+		row := make(map[string]string)
+		for i, value := range result.Values() {
+			row[fields[i].Name] = string(value)
+		}
+		answer = append(answer, row)
+	}
+	if _, err = result.Close(); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
@@ -0,0 +1,73 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestStatementBind(t *testing.T) {
+	var s statement
+	s.param(Column{Meta: MetaData{TypeOID: 25}, Data: Data{Type: 't', Data: []byte("abc")}})
+	s.param(Column{Meta: MetaData{TypeOID: 25}, Data: Data{Type: 't'}})
+	s.param(Column{Meta: MetaData{TypeOID: 23}, Data: Data{Type: 'n'}})
+	s.param(Column{Meta: MetaData{TypeOID: 23}, Data: Data{Type: 'b', Data: []byte{0, 0, 0, 1}}})
+	s.param(Column{Meta: MetaData{TypeOID: firstNormalObjectId + 1}, Data: Data{Type: 't', Data: []byte("red")}})
+	values, formats, oids := s.bind()
+	expected := []struct {
+		value  []byte
+		format int16
+		oid    uint32
+	}{
+		{[]byte("abc"), 0, 25},
+		// an empty text value is not NULL
+		{[]byte{}, 0, 25},
+		{nil, 0, 23},
+		{[]byte{0, 0, 0, 1}, 1, 23},
+		// user defined types are bound without oid, since the oid differs between source and destination
+		{[]byte("red"), 0, 0},
+	}
+	if len(values) != len(expected) || len(formats) != len(expected) || len(oids) != len(expected) {
+		t.Fatalf("expected %d parameters, got %d values, %d formats and %d oids", len(expected), len(values),
+			len(formats), len(oids))
+	}
+	for i, param := range expected {
+		if (values[i] == nil) != (param.value == nil) || string(values[i]) != string(param.value) {
+			t.Errorf("parameter %d: expected value %v, got %v", i+1, param.value, values[i])
+		}
+		if formats[i] != param.format {
+			t.Errorf("parameter %d: expected format %d, got %d", i+1, param.format, formats[i])
+		}
+		if oids[i] != param.oid {
+			t.Errorf("parameter %d: expected oid %d, got %d", i+1, param.oid, oids[i])
+		}
+	}
+}
+
+func TestChangeStatement(t *testing.T) {
+	orders := Tables{{Namespace: "public", TableName: "orders"}}
+	values := textColumns(map[string]*string{"id": strPtr("1"), "note": strPtr("x")})
+	values["blob"] = Column{Meta: MetaData{Name: "blob"}, Data: Data{Type: 'u'}}
+	where := textColumns(map[string]*string{"id": strPtr("1")})
+	for _, test := range []struct {
+		change   Transaction
+		sql      string
+		numParam int
+	}{
+		// unchanged TOAST values are left out, and columns are sorted so that equal statements are prepared once
+		{Transaction{Type: "INSERT", Tables: orders, Values: values},
+			`INSERT INTO "public"."orders" ("id","note") VALUES ($1,$2)`, 2},
+		{Transaction{Type: "UPDATE", Tables: orders, Values: values, Where: where},
+			`UPDATE "public"."orders" SET "id" = $1, "note" = $2 WHERE "id" = $3`, 3},
+		{Transaction{Type: "UPDATE", Tables: orders, Values: values, Where: where, FullIdentity: true},
+			`UPDATE "public"."orders" SET "id" = $1, "note" = $2 WHERE "id" IS NOT DISTINCT FROM $3`, 3},
+		{Transaction{Type: "DELETE", Tables: orders, Where: where}, `DELETE FROM "public"."orders" WHERE "id" = $1`,
+			1},
+	} {
+		s := changeStatement(test.change)
+		if s.sql != test.sql {
+			t.Errorf("%s: expected %s, got %s", test.change.Type, test.sql, s.sql)
+		}
+		if len(s.params) != test.numParam {
+			t.Errorf("%s: expected %d parameters, got %d", test.change.Type, test.numParam, len(s.params))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package pg
+
+import (
+	"fmt"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// Position returns the position of a transaction in the stream from the source, which is the end LSN
+// of envelopes that have one (and the LSN otherwise). Positions increase for every envelope in the stream,
+// except for STREAM chunks (which are interleaved) and the initial copy, which have no position (0).
+func (t Transaction) Position() pglogrepl.LSN {
+	switch t.Type {
+	case "STREAM", "COPY", "COPY DONE", "COPY END":
+		return 0
+	}
+	if t.EndLSN != 0 {
+		return pglogrepl.LSN(t.EndLSN)
+	}
+	return pglogrepl.LSN(t.LSN)
+}
+
+// progressTable returns the table on the destination that holds the position of the last applied envelope
+// for every pipeline
+func (c *Conn) progressTable() (string, error) {
+	table := identifierNameSql(c.config.ProgressTable)
+	if c.progressTableCreated {
+		return table, nil
+	}
+	if err := c.RunSQL(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (pipeline text PRIMARY KEY, lsn pg_lsn NOT NULL, "+
+		"xid bigint NOT NULL, updated timestamptz NOT NULL DEFAULT now())", table)); err != nil {
+		return "", err
+	}
+	c.progressTableCreated = true
+	return table, nil
+}
+
+// applied returns true if an envelope was already applied (its position is at or below the progress of this pipeline),
+// which happens when a message is delivered again after a crash of the reader
+func (c *Conn) applied(t Transaction) (bool, error) {
+	position := t.Position()
+	if position == 0 {
+		return false, nil
+	}
+	if !c.progressLoaded {
+		table, err := c.progressTable()
+		if err != nil {
+			return false, err
+		}
+		rows, err := c.GetRows(fmt.Sprintf("SELECT lsn FROM %s WHERE pipeline = %s", table,
+			stringValueSql(c.config.Pipeline)))
+		if err != nil {
+			return false, err
+		}
+		for _, row := range rows {
+			if c.progressLSN, err = pglogrepl.ParseLSN(row["lsn"]); err != nil {
+				return false, err
+			}
+		}
+		log.Infof("pipeline %s has applied up to %s", c.config.Pipeline, c.progressLSN)
+		c.progressLoaded = true
+	}
+	return position <= c.progressLSN, nil
+}
+
+// progressSql returns the statement that stores the position of an envelope as the progress of this pipeline.
+// It runs in the same destination transaction as the changes of the envelope.
+func (c *Conn) progressSql(t Transaction) (string, error) {
+	table, err := c.progressTable()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("INSERT INTO %s (pipeline, lsn, xid) VALUES (%s, '%s', %d) ON CONFLICT (pipeline) "+
+		"DO UPDATE SET lsn = EXCLUDED.lsn, xid = EXCLUDED.xid, updated = now()",
+		table, stringValueSql(c.config.Pipeline), t.Position(), t.Xid), nil
+}
+
+// setProgress stores the position of an envelope that was applied without a destination transaction
+// (COMMIT PREPARED and ROLLBACK PREPARED)
+func (c *Conn) setProgress(t Transaction) error {
+	sql, err := c.progressSql(t)
+	if err != nil {
+		return err
+	}
+	return c.RunSQL(sql)
+}
@@ -0,0 +1,180 @@
+package pg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TableColumns holds the ColumnRules per table (as schema.table)
+type TableColumns map[string]ColumnRules
+
+// ColumnRules define which columns of a table are published (Include and Exclude), and how they are masked
+type ColumnRules struct {
+	Include []string          `yaml:"include"`
+	Exclude []string          `yaml:"exclude"`
+	Mask    map[string]string `yaml:"mask"`
+}
+
+func (cr ColumnRules) Clone() ColumnRules {
+	clone := ColumnRules{
+		Include: append([]string{}, cr.Include...),
+		Exclude: append([]string{}, cr.Exclude...),
+		Mask:    make(map[string]string),
+	}
+	for column, rule := range cr.Mask {
+		clone.Mask[column] = rule
+	}
+	return clone
+}
+
+// published returns true if a column should be published according to these rules
+func (cr ColumnRules) published(name string) bool {
+	included := len(cr.Include) == 0
+	for _, column := range cr.Include {
+		if column == name {
+			included = true
+			break
+		}
+	}
+	for _, column := range cr.Exclude {
+		if column == name {
+			return false
+		}
+	}
+	return included
+}
+
+// maskRule is a parsed masking rule: `hash`, `null`, `fixed:<value>` or `truncate:<length>`
+type maskRule struct {
+	kind   string
+	value  string
+	length int
+}
+
+func parseMaskRule(rule string) (mask maskRule, err error) {
+	kind, value, _ := strings.Cut(rule, ":")
+	mask.kind = strings.ToLower(kind)
+	switch mask.kind {
+	case "hash", "null":
+		if value != "" {
+			return mask, fmt.Errorf("invalid mask rule %s (%s does not take a value)", rule, mask.kind)
+		}
+	case "fixed":
+		mask.value = value
+	case "truncate":
+		if mask.length, err = strconv.Atoi(value); err != nil || mask.length < 0 {
+			return mask, fmt.Errorf("invalid mask rule %s (truncate requires a length)", rule)
+		}
+	default:
+		return mask, fmt.Errorf("invalid mask rule %s (should be hash, null, fixed:<value> or truncate:<length>)", rule)
+	}
+	return mask, nil
+}
+
+// mask returns the masked column. Hashed values are text (hex encoded sha256, or hmac-sha256 with mask_key),
+// so that the same value always has the same hash (and key columns can still be used in a where clause).
+func (mr maskRule) mask(col Column, key string) (Column, error) {
+	if !col.Data.Changed() {
+		return col, nil
+	}
+	if mr.kind == "null" {
+		col.Data = Data{Type: 'n'}
+		return col, nil
+	} else if mr.kind == "fixed" {
+		col.Data = Data{Type: 't', Length: uint32(len(mr.value)), Data: []byte(mr.value)}
+		return col, nil
+	}
+	text, _, err := columnText(Columns{col.Meta.Name: col}, col.Meta.Name)
+	if err != nil || text == nil {
+		return col, err
+	}
+	value := *text
+	switch mr.kind {
+	case "hash":
+		if key == "" {
+			sum := sha256.Sum256([]byte(value))
+			value = hex.EncodeToString(sum[:])
+		} else {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(value))
+			value = hex.EncodeToString(mac.Sum(nil))
+		}
+		col.Meta.TypeOID = 25
+		col.Meta.TypeName = "text"
+	case "truncate":
+		if runes := []rune(value); len(runes) > mr.length {
+			value = string(runes[:mr.length])
+		}
+	}
+	col.Data = Data{Type: 't', Length: uint32(len(value)), Data: []byte(value)}
+	return col, nil
+}
+
+// projectColumns returns the columns of a table that should be published, with masking applied.
+// With keepAll, excluded columns are not dropped (but they are still masked).
+func (c Config) projectColumns(table Table, cvs Columns, keepAll bool) (Columns, error) {
+	name := fmt.Sprintf("%s.%s", table.Namespace, table.TableName)
+	rules, ok := c.Columns[name]
+	if !ok || cvs == nil {
+		return cvs, nil
+	}
+	projected := make(Columns)
+	for column, col := range cvs {
+		if !keepAll && !rules.published(column) {
+			continue
+		}
+		if mask, masked := c.columnMasks[name][column]; masked {
+			var err error
+			if col, err = mask.mask(col, c.MaskKey); err != nil {
+				return nil, err
+			}
+		}
+		projected[column] = col
+	}
+	return projected, nil
+}
+
+// projectChange applies column projection and masking (see columns) to the values of a change.
+// Key columns in the where clause are only masked (not dropped), unless the table has replica identity full.
+// Since the destination needs the key columns to apply UPDATE and DELETE, a RELATION change returns an error when
+// rules exclude a key column.
+func (c Config) projectChange(t Transaction) (Transaction, error) {
+	if len(t.Tables) != 1 {
+		return t, nil
+	}
+	var err error
+	switch t.Type {
+	case "INSERT", "UPDATE", "DELETE":
+		if t.Values, err = c.projectColumns(t.Tables[0], t.Values, false); err != nil {
+			return t, err
+		}
+		if t.Where, err = c.projectColumns(t.Tables[0], t.Where, !t.FullIdentity); err != nil {
+			return t, err
+		}
+	case "RELATION":
+		name := fmt.Sprintf("%s.%s", t.Tables[0].Namespace, t.Tables[0].TableName)
+		rules, ok := c.Columns[name]
+		if !ok {
+			return t, nil
+		}
+		relation := Relation{ReplicaIdentity: t.Relation.ReplicaIdentity}
+		for _, col := range t.Relation.Columns {
+			if !rules.published(col.Name) && col.Key && t.Relation.ReplicaIdentity != "f" {
+				return t, fmt.Errorf("column %s of %s is part of the replica identity and cannot be excluded "+
+					"(mask it with hash instead)", col.Name, name)
+			} else if !rules.published(col.Name) {
+				continue
+			}
+			if mask, masked := c.columnMasks[name][col.Name]; masked && mask.kind == "hash" {
+				col.TypeOID, col.TypeName, col.Modifier = 25, "text", -1
+			}
+			relation.Columns = append(relation.Columns, col)
+		}
+		t.Relation = &relation
+	}
+	return t, nil
+}
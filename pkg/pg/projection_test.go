@@ -0,0 +1,136 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestParseMaskRule(t *testing.T) {
+	for _, test := range []struct {
+		rule     string
+		expected maskRule
+		invalid  bool
+	}{
+		{rule: "hash", expected: maskRule{kind: "hash"}},
+		{rule: "NULL", expected: maskRule{kind: "null"}},
+		{rule: "fixed:***", expected: maskRule{kind: "fixed", value: "***"}},
+		{rule: "fixed:", expected: maskRule{kind: "fixed"}},
+		{rule: "truncate:3", expected: maskRule{kind: "truncate", length: 3}},
+		{rule: "hash:sha1", invalid: true},
+		{rule: "truncate", invalid: true},
+		{rule: "truncate:-1", invalid: true},
+		{rule: "scramble", invalid: true},
+	} {
+		mask, err := parseMaskRule(test.rule)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseMaskRule(%q): expected an error, got %v", test.rule, mask)
+			}
+		} else if err != nil {
+			t.Errorf("parseMaskRule(%q): unexpected error: %v", test.rule, err)
+		} else if mask != test.expected {
+			t.Errorf("parseMaskRule(%q): expected %v, got %v", test.rule, test.expected, mask)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	for _, test := range []struct {
+		rule     string
+		key      string
+		value    *string
+		expected *string
+		typeName string
+	}{
+		{"hash", "", strPtr("abc"), strPtr("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"), "text"},
+		{"hash", "key", strPtr("The quick brown fox jumps over the lazy dog"),
+			strPtr("f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"), "text"},
+		{"hash", "", nil, nil, "varchar"},
+		{"null", "", strPtr("abc"), nil, "varchar"},
+		{"fixed:***", "", strPtr("abc"), strPtr("***"), "varchar"},
+		{"fixed:***", "", nil, strPtr("***"), "varchar"},
+		{"truncate:2", "", strPtr("héllo"), strPtr("hé"), "varchar"},
+		{"truncate:10", "", strPtr("hello"), strPtr("hello"), "varchar"},
+	} {
+		mask, err := parseMaskRule(test.rule)
+		if err != nil {
+			t.Fatalf("parseMaskRule(%q): unexpected error: %v", test.rule, err)
+		}
+		col := Column{Meta: MetaData{Name: "col", TypeOID: 1043, TypeName: "varchar"}, Data: Data{Type: 'n'}}
+		if test.value != nil {
+			col.Data = Data{Type: 't', Length: uint32(len(*test.value)), Data: []byte(*test.value)}
+		}
+		masked, err := mask.mask(col, test.key)
+		if err != nil {
+			t.Errorf("%s of %v: unexpected error: %v", test.rule, test.value, err)
+			continue
+		}
+		if test.expected == nil {
+			if masked.Data.Type != 'n' {
+				t.Errorf("%s of %v: expected NULL, got %q", test.rule, test.value, masked.Data.Data)
+			}
+		} else if masked.Data.Type != 't' || string(masked.Data.Data) != *test.expected ||
+			masked.Data.Length != uint32(len(*test.expected)) {
+			t.Errorf("%s of %v: expected %q, got %q", test.rule, test.value, *test.expected, masked.Data.Data)
+		}
+		if masked.Meta.TypeName != test.typeName {
+			t.Errorf("%s of %v: expected type %s, got %s", test.rule, test.value, test.typeName,
+				masked.Meta.TypeName)
+		}
+	}
+}
+
+func TestMaskUnchanged(t *testing.T) {
+	mask, err := parseMaskRule("fixed:***")
+	if err != nil {
+		t.Fatal(err)
+	}
+	col := Column{Meta: MetaData{Name: "col"}, Data: Data{Type: 'u'}}
+	if masked, err := mask.mask(col, ""); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if masked.Data.Changed() {
+		t.Errorf("expected unchanged TOAST value to stay unchanged, got %v", masked.Data)
+	}
+}
+
+func TestProjectChange(t *testing.T) {
+	hash, err := parseMaskRule("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{
+		Columns: TableColumns{"public.users": {Exclude: []string{"secret", "id"},
+			Mask: map[string]string{"email": "hash"}}},
+		columnMasks: map[string]map[string]maskRule{"public.users": {"email": hash}},
+	}
+	users := Tables{{Namespace: "public", TableName: "users"}}
+	relation := &Relation{ReplicaIdentity: "d", Columns: []RelationColumn{
+		{Name: "id", Key: true}, {Name: "email", TypeName: "varchar"}, {Name: "secret"},
+	}}
+	if _, err = c.projectChange(Transaction{Type: "RELATION", Tables: users, Relation: relation}); err == nil {
+		t.Errorf("expected an error when excluding a key column")
+	}
+	relation.ReplicaIdentity = "f"
+	projected, err := c.projectChange(Transaction{Type: "RELATION", Tables: users, Relation: relation})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(projected.Relation.Columns) != 1 || projected.Relation.Columns[0].Name != "email" ||
+		projected.Relation.Columns[0].TypeName != "text" {
+		t.Errorf("expected only a hashed email column, got %v", projected.Relation.Columns)
+	}
+
+	row := textColumns(map[string]*string{"id": strPtr("1"), "email": strPtr("abc"), "secret": strPtr("s")})
+	projected, err = c.projectChange(Transaction{Type: "UPDATE", Tables: users, Values: row, Where: row})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := projected.Values["secret"]; ok || len(projected.Values) != 1 {
+		t.Errorf("expected only the email column in values, got %v", projected.Values)
+	}
+	if len(projected.Where) != 3 {
+		t.Errorf("expected all columns in where (without replica identity full), got %v", projected.Where)
+	}
+	if email := string(projected.Values["email"].Data.Data); email == "abc" {
+		t.Errorf("expected email to be hashed")
+	}
+}
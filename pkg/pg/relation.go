@@ -0,0 +1,152 @@
+package pg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Relation holds the metadata of a table as sent by pgoutput in a RelationMessage
+type Relation struct {
+	ReplicaIdentity string
+	Columns         []RelationColumn
+}
+
+// RelationColumn holds the metadata of one column of a Relation.
+// TypeName is the formatted type including the modifier (e.a. `character varying(20)`).
+type RelationColumn struct {
+	Name     string
+	TypeOID  uint32
+	TypeName string
+	Modifier int32
+	Key      bool
+}
+
+// relationChange converts a RelationMessage into a RELATION change, so that consumers receive the column metadata
+func (c *Conn) relationChange(rel *pglogrepl.RelationMessage, xid uint32, lsn pglogrepl.LSN) (t Transaction, err error) {
+	var oids, modifiers []string
+	for _, col := range rel.Columns {
+		oids = append(oids, strconv.FormatUint(uint64(col.DataType), 10))
+		modifiers = append(modifiers, strconv.FormatInt(int64(col.TypeModifier), 10))
+	}
+	typeNames, err := c.GetRows(fmt.Sprintf("SELECT format_type(oid, modifier) type_name "+
+		"FROM unnest('{%s}'::oid[], '{%s}'::int[]) WITH ORDINALITY AS t(oid, modifier, i) ORDER BY i",
+		strings.Join(oids, ","), strings.Join(modifiers, ",")))
+	if err != nil {
+		return t, err
+	} else if len(typeNames) != len(rel.Columns) {
+		return t, fmt.Errorf("could not format types for relation %s.%s", rel.Namespace, rel.RelationName)
+	}
+	relation := Relation{ReplicaIdentity: string(rune(rel.ReplicaIdentity))}
+	for i, col := range rel.Columns {
+		relation.Columns = append(relation.Columns, RelationColumn{
+			Name:     col.Name,
+			TypeOID:  col.DataType,
+			TypeName: typeNames[i]["type_name"],
+			Modifier: col.TypeModifier,
+			Key:      col.Flags == 1,
+		})
+	}
+	return Transaction{
+		LSN:      uint64(lsn),
+		Xid:      xid,
+		Type:     "RELATION",
+		Tables:   Tables{Table{Namespace: rel.Namespace, TableName: rel.RelationName}},
+		Relation: &relation,
+	}, nil
+}
+
+// relationFromCatalog reads the metadata of a table from the catalog (with the primary key as key columns)
+func relationFromCatalog(conn *pgconn.PgConn, table Table) (relation Relation, err error) {
+	rows, err := getRows(conn, fmt.Sprintf("SELECT a.attname, a.atttypid, format_type(a.atttypid, a.atttypmod) "+
+		"type_name, a.atttypmod, coalesce(a.attnum = ANY(i.indkey), false) is_key "+
+		"FROM pg_attribute a LEFT JOIN pg_index i ON i.indrelid = a.attrelid AND i.indisprimary "+
+		"WHERE a.attrelid = %s::regclass AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum",
+		stringValueSql(table.RelationName())))
+	if err != nil {
+		return relation, err
+	}
+	relation.ReplicaIdentity = "d"
+	for _, row := range rows {
+		oid, oErr := strconv.ParseUint(row["atttypid"], 10, 32)
+		if oErr != nil {
+			return relation, oErr
+		}
+		modifier, mErr := strconv.ParseInt(row["atttypmod"], 10, 32)
+		if mErr != nil {
+			return relation, mErr
+		}
+		relation.Columns = append(relation.Columns, RelationColumn{
+			Name:     row["attname"],
+			TypeOID:  uint32(oid),
+			TypeName: row["type_name"],
+			Modifier: int32(modifier),
+			Key:      row["is_key"] == "t",
+		})
+	}
+	return relation, nil
+}
+
+// relationStatements returns the statements that create a missing destination table, and add missing columns
+// (only when create_tables is enabled). Columns are only added when one is missing, since ALTER TABLE locks the table.
+func (c *Conn) relationStatements(t Transaction) []string {
+	if !c.config.CreateTables {
+		return nil
+	}
+	table := t.Tables[0]
+	var columns, names, addColumns, keys []string
+	for _, col := range t.Relation.Columns {
+		definition := fmt.Sprintf("%s %s", identifierNameSql(col.Name), col.TypeName)
+		columns = append(columns, definition)
+		names = append(names, stringValueSql(col.Name))
+		addColumns = append(addColumns, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s", definition))
+		if col.Key {
+			keys = append(keys, identifierNameSql(col.Name))
+		}
+	}
+	// with replica identity full all columns are flagged as key, which does not make a usable primary key
+	if len(keys) > 0 && t.Relation.ReplicaIdentity != "f" {
+		columns = append(columns, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(keys, ", ")))
+	}
+	stmts := []string{
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", identifierNameSql(table.Namespace)),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table.RelationName(), strings.Join(columns, ", ")),
+	}
+	if len(names) == 0 {
+		return stmts
+	}
+	body := fmt.Sprintf("BEGIN IF EXISTS (SELECT FROM unnest(ARRAY[%s]) AS c(name) WHERE NOT EXISTS ("+
+		"SELECT FROM pg_attribute WHERE attrelid = %s::regclass AND attname = c.name AND attnum > 0 "+
+		"AND NOT attisdropped)) THEN ALTER TABLE %s %s; END IF; END", strings.Join(names, ", "),
+		stringValueSql(table.RelationName()), table.RelationName(), strings.Join(addColumns, ", "))
+	return append(stmts, fmt.Sprintf("DO %[1]s %[2]s %[1]s", dollarQuoteTag(body), body))
+}
+
+// dollarQuoteTag returns a dollar quote tag that does not occur in body
+func dollarQuoteTag(body string) string {
+	tag := "$pgarrow$"
+	for i := 1; strings.Contains(body, tag); i++ {
+		tag = fmt.Sprintf("$pgarrow%d$", i)
+	}
+	return tag
+}
+
+// rowIdentity returns the columns that identify the row of an UPDATE or DELETE.
+// For tables without a replica identity the replica_identity_nothing policy applies:
+// with `skip` the change is skipped (identified is false), with `reject` an error is returned.
+func (c *Conn) rowIdentity(change string, rel *pglogrepl.RelationMessage, oldVals Columns, newVals Columns) (
+	where Columns, identified bool, err error) {
+	where = WhereFromLogMsg(rel, oldVals, newVals)
+	if len(where) > 0 {
+		return where, true, nil
+	}
+	if c.config.IdentityNothing == "skip" {
+		log.Warnf("skipping %s on %s.%s, which has no replica identity", change, rel.Namespace, rel.RelationName)
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("cannot replicate %s on %s.%s, which has no replica identity "+
+		"(see replica_identity_nothing)", change, rel.Namespace, rel.RelationName)
+}
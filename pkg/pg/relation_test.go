@@ -0,0 +1,64 @@
+package pg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+func TestRelationStatements(t *testing.T) {
+	c := &Conn{config: &Config{CreateTables: true}}
+	relation := Transaction{Type: "RELATION", Tables: Tables{{Namespace: "public", TableName: "orders"}},
+		Relation: &Relation{ReplicaIdentity: "d", Columns: []RelationColumn{
+			{Name: "id", TypeName: "bigint", Key: true},
+			{Name: "note", TypeName: "character varying(20)"},
+		}}}
+	stmts := c.relationStatements(relation)
+	if len(stmts) != 3 {
+		t.Fatalf("expected 3 statements, got %q", stmts)
+	}
+	if !strings.HasSuffix(stmts[1], `("id" bigint, "note" character varying(20), PRIMARY KEY ("id"))`) {
+		t.Errorf("unexpected CREATE TABLE statement: %s", stmts[1])
+	}
+	// the table is only altered when a column is missing
+	if alter := stmts[2]; !strings.HasPrefix(alter, "DO $pgarrow$ BEGIN IF EXISTS (") ||
+		!strings.Contains(alter, "unnest(ARRAY['id', 'note'])") ||
+		!strings.Contains(alter, `THEN ALTER TABLE "public"."orders" ADD COLUMN IF NOT EXISTS "id" bigint, `+
+			`ADD COLUMN IF NOT EXISTS "note" character varying(20); END IF; END $pgarrow$`) {
+		t.Errorf("unexpected ALTER TABLE statement: %s", alter)
+	}
+
+	relation.Relation.ReplicaIdentity = "f"
+	relation.Relation.Columns[1].Name = "$pgarrow$"
+	stmts = c.relationStatements(relation)
+	if strings.Contains(stmts[1], "PRIMARY KEY") {
+		t.Errorf("expected no primary key with replica identity full: %s", stmts[1])
+	}
+	if !strings.HasPrefix(stmts[2], "DO $pgarrow1$ ") || !strings.HasSuffix(stmts[2], " $pgarrow1$") {
+		t.Errorf("expected another dollar quote tag: %s", stmts[2])
+	}
+
+	c.config.CreateTables = false
+	if stmts = c.relationStatements(relation); len(stmts) != 0 {
+		t.Errorf("expected no statements without create_tables, got %q", stmts)
+	}
+}
+
+func TestRowIdentity(t *testing.T) {
+	rel := &pglogrepl.RelationMessage{Namespace: "public", RelationName: "log", ReplicaIdentity: 'n',
+		Columns: []*pglogrepl.RelationMessageColumn{{Name: "id"}}}
+	row := textColumns(map[string]*string{"id": strPtr("1")})
+	c := &Conn{config: &Config{IdentityNothing: "skip"}}
+	if where, identified, err := c.rowIdentity("DELETE", rel, row, nil); err != nil || identified || where != nil {
+		t.Errorf("skip: expected the change to be skipped, got %v, %v, %v", where, identified, err)
+	}
+	c.config.IdentityNothing = "reject"
+	if _, identified, err := c.rowIdentity("DELETE", rel, row, nil); err == nil || identified {
+		t.Errorf("reject: expected an error, got %v, %v", identified, err)
+	}
+	rel.ReplicaIdentity = 'f'
+	if where, identified, err := c.rowIdentity("DELETE", rel, row, nil); err != nil || !identified || len(where) != 1 {
+		t.Errorf("full: expected the row to be identified, got %v, %v, %v", where, identified, err)
+	}
+}
@@ -7,8 +7,12 @@ package pg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pglogrepl"
@@ -24,9 +28,39 @@ func (c *Conn) StartRepl() (err error) {
 	if err = c.Connect(); err != nil {
 		return err
 	}
+	stateLSN, err := c.identify()
+	if err != nil {
+		return err
+	}
+
+	if c.config.DDLCapture {
+		if err = c.installDDLCapture(); err != nil {
+			return err
+		}
+	}
 
-	_, err = pglogrepl.CreateReplicationSlot(context.Background(), c.rConn, c.config.Slot, "pgoutput",
-		pglogrepl.CreateReplicationSlotOptions{})
+	slotCreated := false
+	copyRequired := c.config.InitialCopy && c.copyPublisher != nil
+	slotOptions := pglogrepl.CreateReplicationSlotOptions{}
+	if copyRequired {
+		if c.config.StateFile == "" {
+			return fmt.Errorf("initial_copy requires a state_file, to detect an initial copy that was interrupted")
+		}
+		slotOptions.SnapshotAction = "EXPORT_SNAPSHOT"
+	}
+	slot, err := pglogrepl.CreateReplicationSlot(context.Background(), c.rConn, c.config.Slot, "pgoutput",
+		slotOptions)
+	if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "42710" && copyRequired && c.copyPending {
+		// the slot was created, but the initial copy did not finish. The snapshot of the slot is gone, so the
+		// copy can only be restarted with a new slot.
+		log.Warnf("initial copy for slot %s was interrupted, recreating the slot to restart it", c.config.Slot)
+		if err = pglogrepl.DropReplicationSlot(context.Background(), c.rConn, c.config.Slot,
+			pglogrepl.DropReplicationSlotOptions{}); err != nil {
+			return err
+		}
+		slot, err = pglogrepl.CreateReplicationSlot(context.Background(), c.rConn, c.config.Slot, "pgoutput",
+			slotOptions)
+	}
 	if pgErr, ok := err.(*pgconn.PgError); ok {
 		if pgErr.Code == "42710" {
 			log.Infoln("Slot already exists")
@@ -36,18 +70,49 @@ func (c *Conn) StartRepl() (err error) {
 	} else if err != nil {
 		log.Fatalln("CreateReplicationSlot failed:", err)
 	} else {
-		log.Info("Created temporary replication slot:", c.config.Slot)
+		slotCreated = true
+		log.Info("Created replication slot:", c.config.Slot)
+	}
+	if slotCreated && copyRequired {
+		// The exported snapshot is only valid until the next command on the replication connection,
+		// so the copy needs to finish before replication is started.
+		c.copyPending = true
+		if err = c.writeState(stateLSN); err != nil {
+			return err
+		}
+		if err = c.startInitialCopy(slot); err != nil {
+			return err
+		}
+		c.copyPending = false
+		if err = c.writeState(stateLSN); err != nil {
+			return err
+		}
 	}
 	if _, err = c.GetXLogPos(); err != nil {
 		return err
 	}
+	if err = c.resume(stateLSN, slotCreated); err != nil {
+		return err
+	}
+	if c.binary, err = c.binarySupported(); err != nil {
+		return err
+	}
+	pluginArgs, err := c.pluginArgs()
+	if err != nil {
+		return err
+	}
+	// Start from the last confirmed position. Transactions that were received but not confirmed before
+	// (e.a. because the message bus was not available) are sent again.
+	c.current = nil
+	c.pending = false
+	c.inStream = false
 	err = pglogrepl.StartReplication(
 		context.Background(),
 		c.rConn,
 		c.config.Slot,
-		c.XLogPos,
+		c.FlushLSN,
 		pglogrepl.StartReplicationOptions{
-			PluginArgs: []string{"proto_version '1'", "publication_names 'pgarrow'"}})
+			PluginArgs: pluginArgs})
 	if err != nil {
 		log.Fatal("StartReplication failed:", err)
 	}
@@ -55,8 +120,171 @@ func (c *Conn) StartRepl() (err error) {
 	return nil
 }
 
-// NextTransactions reads the next transaction and returns. For TRUNCATE this could be more than one.
+// pluginArgs returns the pgoutput options as configured, and checks that the server version supports them
+func (c *Conn) pluginArgs() (args []string, err error) {
+	// minimal server version for every protocol version
+	protoVersions := map[int]int{1: 10, 2: 14, 3: 15, 4: 16}
+	if minVersion, ok := protoVersions[c.config.ProtoVersion]; !ok {
+		return nil, fmt.Errorf("unsupported proto_version %d", c.config.ProtoVersion)
+	} else if c.serverVersion < minVersion {
+		return nil, fmt.Errorf("proto_version %d requires postgres %d or newer (server is %d)",
+			c.config.ProtoVersion, minVersion, c.serverVersion)
+	}
+	var publications []string
+	for _, publication := range c.config.Publications {
+		publications = append(publications, identifierNameSql(publication))
+	}
+	args = append(args,
+		fmt.Sprintf("proto_version '%d'", c.config.ProtoVersion),
+		fmt.Sprintf("publication_names %s", stringValueSql(strings.Join(publications, ","))),
+	)
+	options := []struct {
+		name       string
+		enabled    bool
+		value      string
+		minVersion int
+	}{
+		{"messages", c.config.Messages || c.config.DDLCapture, "true", 14},
+		{"binary", c.binary, "true", 14},
+		// before postgres 16 origin none is handled by pgarrow (see filterOrigin)
+		{"origin", c.config.Origin != "" && c.serverVersion >= 16, c.config.Origin, 16},
+		{"streaming", c.config.Streaming, "on", 14},
+		{"two_phase", c.config.TwoPhase, "on", 15},
+	}
+	if c.config.TwoPhase && c.config.ProtoVersion < 3 {
+		return nil, fmt.Errorf("two_phase requires proto_version 3 or newer")
+	}
+	if c.config.Streaming && c.config.ProtoVersion < 2 {
+		return nil, fmt.Errorf("streaming requires proto_version 2 or newer")
+	}
+	for _, option := range options {
+		if !option.enabled {
+			continue
+		} else if c.serverVersion < option.minVersion {
+			return nil, fmt.Errorf("pgoutput option %s requires postgres %d or newer (server is %d)",
+				option.name, option.minVersion, c.serverVersion)
+		}
+		args = append(args, fmt.Sprintf("%s %s", option.name, stringValueSql(option.value)))
+	}
+	log.Debugf("pgoutput options: %v", args)
+	return args, nil
+}
+
+// binarySupported returns true if binary is enabled, and pgarrow has a binary codec for all column types of the tables
+// in the publications. Otherwise pgoutput is asked for text values, since values of types without a codec cannot be
+// converted for row filters, masks and statements.
+func (c *Conn) binarySupported() (bool, error) {
+	if !c.config.Binary {
+		return false, nil
+	}
+	var publications []string
+	for _, publication := range c.config.Publications {
+		publications = append(publications, stringValueSql(publication))
+	}
+	rows, err := c.GetRows(fmt.Sprintf("SELECT DISTINCT t.oid, t.typname FROM pg_publication_tables p "+
+		"JOIN pg_namespace n ON n.nspname = p.schemaname JOIN pg_class r ON r.relnamespace = n.oid AND "+
+		"r.relname = p.tablename JOIN pg_attribute a ON a.attrelid = r.oid AND a.attnum > 0 AND NOT a.attisdropped "+
+		"JOIN pg_type t ON t.oid = a.atttypid WHERE p.pubname IN (%s)", strings.Join(publications, ", ")))
+	if err != nil {
+		return false, err
+	}
+	var unsupported []string
+	for _, row := range rows {
+		oid, oErr := strconv.ParseUint(row["oid"], 10, 32)
+		if oErr != nil {
+			return false, oErr
+		}
+		if !hasBinaryCodec(uint32(oid), row["typname"]) {
+			unsupported = append(unsupported, row["typname"])
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		log.Warnf("binary is disabled, since pgarrow has no binary codec for column types %s",
+			strings.Join(unsupported, ", "))
+		return false, nil
+	}
+	return true, nil
+}
+
+// unwrapV2 returns the protocol v1 message that is embedded in a protocol v2 message,
+// together with the xid of the streamed transaction it belongs to (0 when not streaming)
+func unwrapV2(msg pglogrepl.Message) (pglogrepl.Message, uint32) {
+	switch v2Msg := msg.(type) {
+	case *pglogrepl.RelationMessageV2:
+		return &v2Msg.RelationMessage, v2Msg.Xid
+	case *pglogrepl.TypeMessageV2:
+		return &v2Msg.TypeMessage, v2Msg.Xid
+	case *pglogrepl.InsertMessageV2:
+		return &v2Msg.InsertMessage, v2Msg.Xid
+	case *pglogrepl.UpdateMessageV2:
+		return &v2Msg.UpdateMessage, v2Msg.Xid
+	case *pglogrepl.DeleteMessageV2:
+		return &v2Msg.DeleteMessage, v2Msg.Xid
+	case *pglogrepl.TruncateMessageV2:
+		return &v2Msg.TruncateMessage, v2Msg.Xid
+	case *pglogrepl.LogicalDecodingMessageV2:
+		return &v2Msg.LogicalDecodingMessage, v2Msg.Xid
+	}
+	return msg, 0
+}
+
+// relationInfo returns the RelationMessage that was last received for a relation ID
+func (c *Conn) relationInfo(relationID uint32) *pglogrepl.RelationMessage {
+	relationInfo, ok := c.relationMessages[relationID]
+	if !ok {
+		log.Fatalf("unknown relation ID %d", relationID)
+	}
+	return relationInfo
+}
+
+// addChange adds a change (INSERT, UPDATE, DELETE or TRUNCATE) to the source transaction that is being received.
+// It returns an error when the row filter or column masks cannot be evaluated.
+func (c *Conn) addChange(t Transaction) (err error) {
+	if c.current == nil {
+		log.Fatalf("received %s outside of a transaction", t.Type)
+	}
+	if c.current.Origin != "" && c.filterOrigin() && t.Type != "RELATION" {
+		// changes that were applied by a replication origin are not published (origin none), but relation metadata
+		// is, since pgoutput only sends it once
+		return nil
+	}
+	var included bool
+	if t, included, err = c.config.rowChange(t); err != nil || !included {
+		return err
+	}
+	if t, err = c.config.projectChange(t); err != nil {
+		return err
+	}
+	if ce := quickLog.Check(zap.DebugLevel, "change"); ce != nil {
+		ce.Write(
+			zap.Any("body", t),
+			zap.Any("sql", t.Sql()),
+		)
+	}
+	c.current.Changes = append(c.current.Changes, t)
+	return nil
+}
+
+// ErrConnectionLost is returned by NextTransactions when replication stopped (e.a. the source is restarted), in which
+// case replication can be restarted with a new connection. All other errors are returned as is.
+var ErrConnectionLost = errors.New("replication connection lost")
+
+// NextTransactions reads the next source transaction and returns it as one COMMIT envelope,
+// which holds all changes (INSERT, UPDATE, DELETE and TRUNCATE) between BEGIN and COMMIT.
+// With streaming enabled, large in-progress transactions are returned as STREAM chunks (one per
+// STREAM START / STREAM STOP), followed by a STREAM COMMIT or STREAM ABORT with the same xid.
+// With two_phase enabled, prepared transactions are returned as a PREPARE envelope (BEGIN PREPARE until PREPARE),
+// followed by a COMMIT PREPARED or ROLLBACK PREPARED with the same gid.
+// Every envelope is stamped with the source_id.
 func (c *Conn) NextTransactions() (t Transaction, err error) {
+	t, err = c.nextTransaction()
+	t.SourceID = c.config.SourceID
+	return t, err
+}
+
+// nextTransaction reads the next envelope from the replication connection (see NextTransactions)
+func (c *Conn) nextTransaction() (t Transaction, err error) {
 	standbyMessageTimeout := c.config.StandbyMessageTimeout
 	nextStandbyMessageDeadline := time.Now().Add(standbyMessageTimeout)
 
@@ -69,7 +297,7 @@ func (c *Conn) NextTransactions() (t Transaction, err error) {
 	)
 	for {
 		if time.Now().After(nextStandbyMessageDeadline) {
-			err = pglogrepl.SendStandbyStatusUpdate(context.Background(), c.rConn, pglogrepl.StandbyStatusUpdate{WALWritePosition: c.XLogPos})
+			err = pglogrepl.SendStandbyStatusUpdate(context.Background(), c.rConn, c.standbyStatus())
 			if err != nil {
 				log.Fatal("SendStandbyStatusUpdate failed:", err)
 			}
@@ -85,12 +313,12 @@ func (c *Conn) NextTransactions() (t Transaction, err error) {
 				continue
 			}
 			log.Info("ReceiveMessage failed:", err)
-			return t, err
+			return t, fmt.Errorf("%w: %v", ErrConnectionLost, err)
 		}
 
 		if errMsg, ok := rawMsg.(*pgproto3.ErrorResponse); ok {
 			log.Error("received Postgres WAL error: ", errMsg)
-			return t, err
+			return t, fmt.Errorf("%w: %s", ErrConnectionLost, errMsg.Message)
 		}
 
 		msg, ok := rawMsg.(*pgproto3.CopyData)
@@ -134,10 +362,18 @@ func (c *Conn) NextTransactions() (t Transaction, err error) {
 					zap.Any("WALData", xld.WALData),
 				)
 			}
-			parsedMsg, err = pglogrepl.Parse(xld.WALData)
+			if parsedMsg, err = parseTwoPhase(xld.WALData); err != nil || parsedMsg != nil {
+				// two-phase message, or error while decoding it
+			} else if c.config.ProtoVersion >= 2 {
+				parsedMsg, err = pglogrepl.ParseV2(xld.WALData, c.inStream)
+			} else {
+				parsedMsg, err = pglogrepl.Parse(xld.WALData)
+			}
 			if err != nil {
 				log.Fatalf("Parse logical replication message: %s", err)
 			}
+			// xid is only set for messages within a stream of an in-progress transaction (proto_version 2+)
+			parsedMsg, xid := unwrapV2(parsedMsg)
 
 			if ce := quickLog.Check(zap.DebugLevel, "XLogMsg"); ce != nil {
 				ce.Write(zap.Any("type", parsedMsg.Type()))
@@ -146,94 +382,262 @@ func (c *Conn) NextTransactions() (t Transaction, err error) {
 			switch logicalMsg := parsedMsg.(type) {
 			case *pglogrepl.RelationMessage:
 				c.relationMessages[logicalMsg.RelationID] = logicalMsg
+				if c.current == nil || !c.config.tableIncluded(Table{Namespace: logicalMsg.Namespace,
+					TableName: logicalMsg.RelationName}) {
+					break
+				}
+				if err = c.config.checkRowFilter(logicalMsg); err != nil {
+					return t, err
+				}
+				relation, rErr := c.relationChange(logicalMsg, xid, xld.WALStart)
+				if rErr != nil {
+					log.Fatalf("could not retrieve metadata for relation %d: %v", logicalMsg.RelationID, rErr)
+				}
+				if err = c.addChange(relation); err != nil {
+					return t, err
+				}
 
 			case *pglogrepl.BeginMessage:
 				// Indicates the beginning of a group of changes in a transaction.
 				// This is only sent for committed transactions.
 				// You won't get any events from rolled back transactions.
+				c.current = &Transaction{
+					LSN:        uint64(xld.WALStart),
+					Xid:        logicalMsg.Xid,
+					CommitLSN:  uint64(logicalMsg.FinalLSN),
+					CommitTime: logicalMsg.CommitTime,
+					Type:       "COMMIT",
+				}
 
 			case *pglogrepl.CommitMessage:
+				if c.current == nil {
+					log.Fatalf("received COMMIT (lsn %s) without BEGIN", logicalMsg.CommitLSN)
+				}
+				t = *c.current
+				c.current = nil
+				c.XLogPos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+				if len(t.Changes) == 0 {
+					log.Debugf("skipping empty transaction (xid %d)", t.Xid)
+					t = Transaction{}
+					continue
+				}
+				t.CommitLSN = uint64(logicalMsg.CommitLSN)
+				t.EndLSN = uint64(logicalMsg.TransactionEndLSN)
+				t.CommitTime = logicalMsg.CommitTime
+				c.pending = true
+				if ce := quickLog.Check(zap.DebugLevel, "transaction"); ce != nil {
+					ce.Write(
+						zap.Uint32("xid", t.Xid),
+						zap.Int("changes", len(t.Changes)),
+						zap.Any("sql", t.Sql()),
+					)
+				}
+				return t, err
 
-			case *pglogrepl.InsertMessage:
-				relationInfo, ok = c.relationMessages[logicalMsg.RelationID]
-				if !ok {
-					log.Fatalf("unknown relation ID %d", logicalMsg.RelationID)
+			case *pglogrepl.StreamStartMessageV2:
+				// Indicates the beginning of a chunk of changes of a (large) in-progress transaction.
+				c.inStream = true
+				c.current = &Transaction{
+					LSN:          uint64(xld.WALStart),
+					Xid:          logicalMsg.Xid,
+					Type:         "STREAM",
+					FirstSegment: logicalMsg.FirstSegment == 1,
+					Origin:       c.originXids[logicalMsg.Xid],
 				}
 
+			case *pglogrepl.StreamStopMessageV2:
+				if c.current == nil {
+					log.Fatal("received STREAM STOP without STREAM START")
+				}
+				t = *c.current
+				c.current = nil
+				c.inStream = false
+				c.XLogPos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+				if len(t.Changes) == 0 && !t.FirstSegment {
+					log.Debugf("skipping empty stream chunk (xid %d)", t.Xid)
+					t = Transaction{}
+					continue
+				}
+				c.pending = true
+				if ce := quickLog.Check(zap.DebugLevel, "stream chunk"); ce != nil {
+					ce.Write(
+						zap.Uint32("xid", t.Xid),
+						zap.Int("changes", len(t.Changes)),
+					)
+				}
+				return t, err
+
+			case *pglogrepl.StreamCommitMessageV2:
+				delete(c.originXids, logicalMsg.Xid)
+				c.XLogPos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+				c.pending = true
+				return Transaction{
+					LSN:        uint64(xld.WALStart),
+					Xid:        logicalMsg.Xid,
+					CommitLSN:  uint64(logicalMsg.CommitLSN),
+					EndLSN:     uint64(logicalMsg.TransactionEndLSN),
+					CommitTime: logicalMsg.CommitTime,
+					Type:       "STREAM COMMIT",
+				}, err
+
+			case *pglogrepl.StreamAbortMessageV2:
+				if logicalMsg.Xid == logicalMsg.SubXid {
+					delete(c.originXids, logicalMsg.Xid)
+				}
+				c.XLogPos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+				c.pending = true
+				return Transaction{
+					LSN:    uint64(xld.WALStart),
+					Xid:    logicalMsg.Xid,
+					SubXid: logicalMsg.SubXid,
+					Type:   "STREAM ABORT",
+				}, err
+
+			case *PrepareMessage:
+				if logicalMsg.Type() == MessageTypeBeginPrepare {
+					c.current = &Transaction{
+						LSN:        uint64(xld.WALStart),
+						Xid:        logicalMsg.Xid,
+						CommitLSN:  uint64(logicalMsg.LSN),
+						CommitTime: logicalMsg.Time,
+						GID:        logicalMsg.GID,
+						Type:       "PREPARE",
+					}
+					break
+				}
+				t = Transaction{
+					LSN:        uint64(xld.WALStart),
+					Xid:        logicalMsg.Xid,
+					CommitLSN:  uint64(logicalMsg.LSN),
+					EndLSN:     uint64(logicalMsg.EndLSN),
+					CommitTime: logicalMsg.Time,
+					GID:        logicalMsg.GID,
+				}
+				switch logicalMsg.Type() {
+				case MessageTypePrepare:
+					if c.current == nil {
+						log.Fatalf("received PREPARE (gid %s) without BEGIN PREPARE", logicalMsg.GID)
+					}
+					t.Type = "PREPARE"
+					t.Changes = c.current.Changes
+					c.current = nil
+				case MessageTypeCommitPrepared:
+					t.Type = "COMMIT PREPARED"
+				case MessageTypeStreamPrepare:
+					t.Type = "STREAM PREPARE"
+				}
+				c.XLogPos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+				c.pending = true
+				if ce := quickLog.Check(zap.DebugLevel, "two-phase transaction"); ce != nil {
+					ce.Write(
+						zap.String("type", t.Type),
+						zap.String("gid", t.GID),
+						zap.Int("changes", len(t.Changes)),
+					)
+				}
+				return t, err
+
+			case *RollbackPreparedMessage:
+				c.XLogPos = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+				c.pending = true
+				return Transaction{
+					LSN:        uint64(xld.WALStart),
+					Xid:        logicalMsg.Xid,
+					GID:        logicalMsg.GID,
+					EndLSN:     uint64(logicalMsg.RollbackEndLSN),
+					CommitTime: logicalMsg.RollbackTime,
+					Type:       "ROLLBACK PREPARED",
+				}, err
+
+			case *pglogrepl.InsertMessage:
+				relationInfo = c.relationInfo(logicalMsg.RelationID)
+				if !c.config.tableIncluded(Table{Namespace: relationInfo.Namespace, TableName: relationInfo.RelationName}) {
+					break
+				}
 				newValues := ColValsFromLogMsg(logicalMsg.Tuple.Columns, relationInfo)
 				log.Debugf("INSERT INTO %s.%s: %v", relationInfo.Namespace, relationInfo.RelationName, relationInfo)
 
-				t = Transaction{
+				if err = c.addChange(Transaction{
 					LSN:  uint64(xld.WALStart),
+					Xid:  xid,
 					Type: "INSERT",
 					Tables: Tables{Table{
 						Namespace: relationInfo.Namespace,
 						TableName: relationInfo.RelationName,
 					}},
 					Values: newValues,
+				}); err != nil {
+					return t, err
 				}
-				if ce := quickLog.Check(zap.DebugLevel, "transaction"); ce != nil {
-					ce.Write(
-						zap.Any("body", t),
-						zap.Any("sql", t.Sql()),
-					)
-				}
-				return t, err
 
 			case *pglogrepl.UpdateMessage:
-				relationInfo, ok = c.relationMessages[logicalMsg.RelationID]
-				if !ok {
-					log.Fatalf("unknown relation ID %d", logicalMsg.RelationID)
+				relationInfo = c.relationInfo(logicalMsg.RelationID)
+				if !c.config.tableIncluded(Table{Namespace: relationInfo.Namespace, TableName: relationInfo.RelationName}) {
+					break
 				}
-
 				log.Debugf("RELTYPE   %v", relationInfo)
 
 				newValues := ColValsFromLogMsg(logicalMsg.NewTuple.Columns, relationInfo)
 				//				log.Printf("DEBUG UPDATE %s.%s: %v", rel.Namespace, rel.RelationName, new_values)
 
-				originalValues := ColValsFromLogMsg(logicalMsg.OldTuple.Columns, relationInfo)
-				whereVals := WhereFromLogMsg(c.relationMessages[logicalMsg.RelationID].Columns, originalValues)
-				t = Transaction{
+				if c.config.FetchToast {
+					if err = c.fetchToast(relationInfo, newValues); err != nil {
+						return t, err
+					}
+				}
+				var originalValues Columns
+				if logicalMsg.OldTuple != nil {
+					originalValues = ColValsFromLogMsg(logicalMsg.OldTuple.Columns, relationInfo)
+				}
+				whereVals, identified, iErr := c.rowIdentity("UPDATE", relationInfo, originalValues, newValues)
+				if iErr != nil {
+					return t, iErr
+				} else if !identified {
+					break
+				}
+				if err = c.addChange(Transaction{
 					LSN:  uint64(xld.WALStart),
+					Xid:  xid,
 					Type: "UPDATE",
 					Tables: Tables{Table{
 						Namespace: relationInfo.Namespace,
 						TableName: relationInfo.RelationName,
 					}},
-					Values: newValues,
-					Where:  whereVals,
+					Values:       newValues,
+					Where:        whereVals,
+					FullIdentity: relationInfo.ReplicaIdentity == 'f',
+				}); err != nil {
+					return t, err
 				}
-				if ce := quickLog.Check(zap.DebugLevel, "transaction"); ce != nil {
-					ce.Write(
-						zap.Any("body", t),
-						zap.Any("sql", t.Sql()),
-					)
-				}
-				return t, err
+
 			case *pglogrepl.DeleteMessage:
-				relationInfo, ok = c.relationMessages[logicalMsg.RelationID]
-				if !ok {
-					log.Fatalf("unknown relation ID %d", logicalMsg.RelationID)
+				relationInfo = c.relationInfo(logicalMsg.RelationID)
+				if !c.config.tableIncluded(Table{Namespace: relationInfo.Namespace, TableName: relationInfo.RelationName}) {
+					break
 				}
-
-				oldValues := ColValsFromLogMsg(logicalMsg.OldTuple.Columns, relationInfo)
-				whereVals := WhereFromLogMsg(c.relationMessages[logicalMsg.RelationID].Columns, oldValues)
-				t = Transaction{
+				var oldValues Columns
+				if logicalMsg.OldTuple != nil {
+					oldValues = ColValsFromLogMsg(logicalMsg.OldTuple.Columns, relationInfo)
+				}
+				whereVals, identified, iErr := c.rowIdentity("DELETE", relationInfo, oldValues, nil)
+				if iErr != nil {
+					return t, iErr
+				} else if !identified {
+					break
+				}
+				if err = c.addChange(Transaction{
 					LSN:  uint64(xld.WALStart),
+					Xid:  xid,
 					Type: "DELETE",
 					Tables: Tables{Table{
 						Namespace: relationInfo.Namespace,
 						TableName: relationInfo.RelationName,
 					}},
-					Where: whereVals,
+					Where:        whereVals,
+					FullIdentity: relationInfo.ReplicaIdentity == 'f',
+				}); err != nil {
+					return t, err
 				}
-				if ce := quickLog.Check(zap.DebugLevel, "transaction"); ce != nil {
-					ce.Write(
-						zap.Any("body", t),
-						zap.Any("sql", t.Sql()),
-					)
-				}
-				return t, err
 
 			case *pglogrepl.TruncateMessage:
 				log.Debug(logicalMsg)
@@ -243,23 +647,66 @@ func (c *Conn) NextTransactions() (t Transaction, err error) {
 					if table, err = c.GetTableFromOID(oid); err != nil {
 						log.Fatalf("could not retrieve relation OID %d", logicalMsg.RelationNum)
 					}
-					tables = append(tables, table)
+					if c.config.tableIncluded(table) {
+						tables = append(tables, table)
+					}
 				}
-				t = Transaction{
+				if len(tables) == 0 {
+					break
+				}
+				if err = c.addChange(Transaction{
 					LSN:    uint64(xld.WALStart),
+					Xid:    xid,
 					Type:   "TRUNCATE",
 					Tables: tables,
+				}); err != nil {
+					return t, err
 				}
-				if ce := quickLog.Check(zap.DebugLevel, "transaction"); ce != nil {
-					ce.Write(
-						zap.Any("body", t),
-						zap.Any("sql", t.Sql()),
-					)
+
+			case *pglogrepl.LogicalDecodingMessage:
+				m := Transaction{
+					LSN:  uint64(logicalMsg.LSN),
+					Xid:  xid,
+					Type: "MESSAGE",
+					Message: &LogicalMessage{
+						Prefix:        logicalMsg.Prefix,
+						Transactional: logicalMsg.Transactional,
+						// copy, since the receive buffer is reused for the next message
+						Content: append([]byte{}, logicalMsg.Content...),
+					},
 				}
-				return t, err
+				if m.Message.Prefix == ddlMessagePrefix {
+					if !c.config.DDLCapture {
+						break
+					}
+					ddl, add, dErr := c.ddlChange(m)
+					if dErr != nil {
+						log.Fatal(dErr)
+					} else if add {
+						if err = c.addChange(ddl); err != nil {
+							return t, err
+						}
+					}
+					break
+				} else if !c.config.Messages {
+					// messages are only sent for DDL capture
+					break
+				} else if logicalMsg.Transactional {
+					if err = c.addChange(m); err != nil {
+						return t, err
+					}
+					break
+				}
+				// Non-transactional messages are published immediately (even if a transaction is being received)
+				c.pending = true
+				if ce := quickLog.Check(zap.DebugLevel, "message"); ce != nil {
+					ce.Write(zap.Any("body", m))
+				}
+				return m, err
 
 			case *pglogrepl.TypeMessage:
 			case *pglogrepl.OriginMessage:
+				c.setOrigin(logicalMsg.Name)
 			default:
 				log.Infof("Unknown message type in pgoutput stream: %T", logicalMsg)
 			}
@@ -0,0 +1,141 @@
+package pg
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// RetryPolicy defines how often (and how fast) statements on the destination are retried after an error
+type RetryPolicy struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Jitter         float64       `yaml:"jitter"`
+	Reconnect      bool          `yaml:"reconnect"`
+}
+
+// RetryPolicies holds the RetryPolicy per SQLSTATE (e.a. 40001), SQLSTATE class (e.a. 08), or `connection`
+// (for errors without SQLSTATE after which the connection is closed)
+type RetryPolicies map[string]RetryPolicy
+
+// defaultRetryPolicies are used for all errors that have no retry policy in the config
+var defaultRetryPolicies = RetryPolicies{
+	"connection": {Reconnect: true},
+	"08":         {Reconnect: true}, // connection exception
+	"25006":      {Reconnect: true}, // read only sql transaction (e.a. the destination was demoted during a failover)
+	"40001":      {},                // serialization failure
+	"40P01":      {},                // deadlock detected
+	"53":         {},                // insufficient resources (e.a. disk full or too many connections)
+	"55P03":      {},                // lock not available (lock_timeout)
+	"57P01":      {Reconnect: true}, // admin shutdown
+	"57P02":      {Reconnect: true}, // crash shutdown
+	"57P03":      {Reconnect: true}, // cannot connect now
+	"58":         {},                // system error (e.a. an I/O error)
+}
+
+func (rp RetryPolicies) Clone() RetryPolicies {
+	clone := make(RetryPolicies)
+	for key, policy := range rp {
+		clone[key] = policy
+	}
+	return clone
+}
+
+// initialize adds the default retry policies, and sets defaults for all policies
+func (rp RetryPolicies) initialize() error {
+	for key, policy := range defaultRetryPolicies {
+		if _, ok := rp[key]; !ok {
+			rp[key] = policy
+		}
+	}
+	for key, policy := range rp {
+		if key != "connection" && len(key) != 2 && len(key) != 5 {
+			return fmt.Errorf("invalid retry policy %s, should be a SQLSTATE, a SQLSTATE class or `connection`", key)
+		}
+		if policy.MaxAttempts < 1 {
+			policy.MaxAttempts = 10
+		}
+		if policy.InitialBackoff.Milliseconds() < 1 {
+			policy.InitialBackoff = 100 * time.Millisecond
+		}
+		if policy.MaxBackoff < policy.InitialBackoff {
+			policy.MaxBackoff = 30 * time.Second
+		}
+		if policy.Jitter <= 0 || policy.Jitter > 1 {
+			policy.Jitter = 0.2
+		}
+		rp[key] = policy
+	}
+	return nil
+}
+
+// backoff returns the time to wait before the next attempt: the initial backoff doubles with every attempt
+// (up to the max backoff), and is randomly spread by the jitter
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < attempt && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	return time.Duration(float64(backoff) * (1 + policy.Jitter*(2*rand.Float64()-1)))
+}
+
+// policy returns the retry policy for a SQLSTATE: the policy of the SQLSTATE, or of its SQLSTATE class
+func (rp RetryPolicies) policy(code string) (policy RetryPolicy, key string, ok bool) {
+	if policy, ok = rp[code]; ok {
+		return policy, code, true
+	}
+	policy, ok = rp[code[:2]]
+	return policy, code[:2], ok
+}
+
+// retryPolicy returns the retry policy for an error: the policy of its SQLSTATE, or of its SQLSTATE class,
+// or the connection policy when the error closed the apply connection
+func (c *Conn) retryPolicy(err error) (policy RetryPolicy, key string, ok bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return c.config.Retry.policy(pgErr.Code)
+	}
+	if c.aConn == nil || c.aConn.IsClosed() {
+		policy, ok = c.config.Retry["connection"]
+		return policy, "connection", ok
+	}
+	return policy, "", false
+}
+
+// withRetries runs run (with the number of retries so far), and retries it according to the retry policy of the
+// error. It returns the number of retries that were done.
+func (c *Conn) withRetries(what string, run func(retry int) error) (retries int, err error) {
+	for attempt := 1; ; attempt++ {
+		if err = run(attempt - 1); err == nil {
+			return attempt - 1, nil
+		}
+		policy, key, ok := c.retryPolicy(err)
+		if !ok || attempt >= policy.MaxAttempts {
+			return attempt - 1, err
+		}
+		backoff := policy.backoff(attempt)
+		log.Warnf("%s failed (attempt %d of %d, retry policy %s), retrying in %s: %v", what, attempt,
+			policy.MaxAttempts, key, backoff, err)
+		if policy.Reconnect {
+			c.closeApply()
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// closeApply closes the apply connection, so that the next statement reconnects.
+// The progress is loaded again, since a commit could have succeeded before the connection was lost.
+func (c *Conn) closeApply() {
+	if err := _close(c.aConn); err != nil {
+		log.Errorf("Error closing aConn: %v", err)
+	}
+	c.aConn = nil
+	c.progressLoaded = false
+}
@@ -0,0 +1,51 @@
+package pg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, expected := range []time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		6: time.Second,
+	} {
+		if attempt == 0 {
+			continue
+		}
+		if backoff := policy.backoff(attempt); backoff != expected {
+			t.Errorf("backoff(%d): expected %s, got %s", attempt, expected, backoff)
+		}
+	}
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if backoff := policy.backoff(2); backoff < 160*time.Millisecond || backoff > 240*time.Millisecond {
+			t.Fatalf("backoff(2) with jitter 0.2: expected between 160ms and 240ms, got %s", backoff)
+		}
+	}
+}
+
+func TestRetryPoliciesInitialize(t *testing.T) {
+	rp := RetryPolicies{"40001": {MaxAttempts: 3}}
+	if err := rp.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if policy := rp["40001"]; policy.MaxAttempts != 3 || policy.InitialBackoff != 100*time.Millisecond ||
+		policy.MaxBackoff != 30*time.Second || policy.Jitter != 0.2 {
+		t.Errorf("expected defaults to be set, got %v", policy)
+	}
+	if policy, key, ok := rp.policy("08006"); !ok || key != "08" || !policy.Reconnect {
+		t.Errorf("expected the policy of class 08 for 08006, got %s (%v)", key, ok)
+	}
+	if _, _, ok := rp.policy("23505"); ok {
+		t.Errorf("expected no policy for 23505")
+	}
+	if err := (RetryPolicies{"4000": {}}).initialize(); err == nil {
+		t.Errorf("expected an error for an invalid SQLSTATE")
+	}
+}
@@ -7,4 +7,5 @@ type slotInfo struct {
 	name       string
 	active     bool
 	restartLsn pglogrepl.LSN
+	flushLsn   pglogrepl.LSN
 }
@@ -0,0 +1,77 @@
+package pg
+
+import "fmt"
+
+// sourceColumn returns the column that holds the source_id of a change (see source_column)
+func sourceColumn(name string, sourceID string) Column {
+	return Column{
+		Data: Data{Type: 't', Length: uint32(len(sourceID)), Data: []byte(sourceID)},
+		Meta: MetaData{Flags: 1, Name: name, TypeOID: 25, TypeName: "text", Modifier: -1},
+	}
+}
+
+// withColumn returns a copy of the columns with one column added
+func (cvs Columns) withColumn(col Column) Columns {
+	added := Columns{col.Meta.Name: col}
+	for name, value := range cvs {
+		if name != col.Meta.Name {
+			added[name] = value
+		}
+	}
+	return added
+}
+
+// sourceChange adds the source_id of a change to the source_column (see source_column): it is inserted with the row
+// (also for UPDATE, in case the row is missing and inserted by update_missing), and added to the where clause of UPDATE
+// and DELETE, so that rows of different sources with the same key do not collide. For RELATION changes the column is
+// added as a key column when the table has key columns (a table without key gets no primary key on the destination,
+// so that it can hold the rows of all sources).
+func (c Config) sourceChange(t Transaction) (Transaction, error) {
+	if c.SourceColumn == "" {
+		return t, nil
+	}
+	switch t.Type {
+	case "INSERT", "UPDATE", "DELETE", "TRUNCATE", "RELATION":
+	default:
+		return t, nil
+	}
+	if t.SourceID == "" {
+		return t, permanentf("%s change (lsn %d) has no source_id, which is required with source_column", t.Type,
+			t.LSN)
+	}
+	col := sourceColumn(c.SourceColumn, t.SourceID)
+	switch t.Type {
+	case "INSERT":
+		t.Values = t.Values.withColumn(col)
+	case "UPDATE":
+		t.Values = t.Values.withColumn(col)
+		t.Where = t.Where.withColumn(col)
+	case "DELETE":
+		t.Where = t.Where.withColumn(col)
+	case "RELATION":
+		relation := Relation{ReplicaIdentity: t.Relation.ReplicaIdentity, Columns: []RelationColumn{{
+			Name:     col.Meta.Name,
+			TypeOID:  col.Meta.TypeOID,
+			TypeName: col.Meta.TypeName,
+			Modifier: col.Meta.Modifier,
+		}}}
+		for _, relCol := range t.Relation.Columns {
+			if relCol.Name != col.Meta.Name {
+				relation.Columns = append(relation.Columns, relCol)
+				relation.Columns[0].Key = relation.Columns[0].Key || relCol.Key
+			}
+		}
+		t.Relation = &relation
+	}
+	return t, nil
+}
+
+// sourceTruncateStatements returns the statements for a TRUNCATE with source_column, which only deletes the rows
+// of the source of the change (since the tables on the destination are shared with other sources)
+func (c Config) sourceTruncateStatements(t Transaction) (stmts []string) {
+	for _, table := range t.Tables {
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM %s WHERE %s = %s", table.RelationName(),
+			identifierNameSql(c.SourceColumn), stringValueSql(t.SourceID)))
+	}
+	return stmts
+}
@@ -0,0 +1,166 @@
+package pg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// replState is the replication state that is stored in the state_file.
+// Replication slots are instance local, so after a failover the slot on the new primary could be missing (or behind).
+// The state file is used to detect such a failover and to resume from the last confirmed position.
+// CopyPending is set while the initial copy for the slot is running, so that an interrupted copy is detected.
+type replState struct {
+	SystemID    string
+	Timeline    int32
+	Slot        string
+	LSN         uint64
+	CopyPending bool `json:",omitempty"`
+	Updated     time.Time
+}
+
+func loadState(path string) (state replState, exists bool, err error) {
+	// #nosec G304 -- path comes from the config
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, false, nil
+	} else if err != nil {
+		return state, false, err
+	}
+	if err = json.Unmarshal(raw, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
+
+// save writes the state to a temporary file and renames it, so that the state file is never half written.
+// Both the file and the directory are synced, so that the state survives a crash of the host.
+func (s replState) save(path string) (err error) {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	// #nosec G304 -- path comes from the config
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(raw); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if err = dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// identify runs IDENTIFY_SYSTEM and compares the result with the state file.
+// It returns the last confirmed LSN from the state file (0 if there is none).
+// After a failover (the timeline changed) pgarrow resumes from the state file, and resume checks for a gap.
+// A different system identifier means a different cluster, where the LSN of the state file means nothing, so an error
+// is returned unless this is accepted with accept_failover.
+func (c *Conn) identify() (stateLSN pglogrepl.LSN, err error) {
+	if c.identity, err = pglogrepl.IdentifySystem(context.Background(), c.rConn); err != nil {
+		return 0, err
+	}
+	log.Debugf("connected to system %s (timeline %d)", c.identity.SystemID, c.identity.Timeline)
+	if c.config.StateFile == "" {
+		return 0, nil
+	}
+	state, exists, err := loadState(c.config.StateFile)
+	if err != nil || !exists {
+		return 0, err
+	} else if state.Slot != c.config.Slot {
+		log.Warnf("state file %s is for slot %s (instead of %s), ignoring it", c.config.StateFile, state.Slot,
+			c.config.Slot)
+		return 0, nil
+	}
+	if state.SystemID != c.identity.SystemID {
+		msg := fmt.Sprintf("system identifier changed from %s to %s since last run, this is a different cluster",
+			state.SystemID, c.identity.SystemID)
+		if !c.config.AcceptFailover {
+			return 0, fmt.Errorf("%s: verify the destination, and set accept_failover to continue", msg)
+		}
+		log.Warnf("%s (accepted with accept_failover)", msg)
+	} else if state.Timeline != c.identity.Timeline {
+		log.Warnf("timeline changed from %d to %d since last run, a failover has happened", state.Timeline,
+			c.identity.Timeline)
+	}
+	c.copyPending = state.CopyPending
+	return pglogrepl.LSN(state.LSN), nil
+}
+
+// resume derives the position to resume from, and reports a gap if changes have been lost.
+// Changes after the last confirmed LSN (stateLSN) and before the confirmed flush LSN of the slot cannot be
+// decoded anymore, e.a. when the slot was recreated on a new primary after a failover. A gap returns an error,
+// unless it is accepted with accept_failover.
+func (c *Conn) resume(stateLSN pglogrepl.LSN, slotCreated bool) error {
+	if stateLSN == 0 {
+		return nil
+	}
+	if c.FlushLSN > stateLSN {
+		gap := fmt.Sprintf("!!! GAP DETECTED !!! changes between LSN %s (last confirmed) and LSN %s (slot %s) "+
+			"cannot be replicated. The destination is missing these changes and needs to be resynchronized.",
+			stateLSN, c.FlushLSN, c.config.Slot)
+		if !c.config.AcceptFailover {
+			return fmt.Errorf("%s Set accept_failover to continue", gap)
+		}
+		log.Error(gap)
+	} else if c.FlushLSN < stateLSN {
+		log.Infof("slot %s is behind the state file, resuming from LSN %s (instead of %s)", c.config.Slot,
+			stateLSN, c.FlushLSN)
+		c.FlushLSN = stateLSN
+	} else if slotCreated {
+		log.Infof("slot %s was recreated at the last confirmed LSN %s", c.config.Slot, stateLSN)
+	}
+	c.savedLSN = c.FlushLSN
+	return nil
+}
+
+// saveState writes the confirmed flush LSN to the state file (if configured and changed).
+// It is called with every standby status update, so that the state file is synced once per standby_message_timeout
+// (instead of for every confirmed transaction), and is never behind the slot.
+func (c *Conn) saveState() {
+	if c.config.StateFile == "" || c.FlushLSN == c.savedLSN {
+		return
+	}
+	if err := c.writeState(c.FlushLSN); err != nil {
+		log.Errorf("could not write state file %s: %v", c.config.StateFile, err)
+		return
+	}
+	c.savedLSN = c.FlushLSN
+}
+
+// writeState writes the state file with a confirmed LSN
+func (c *Conn) writeState(lsn pglogrepl.LSN) error {
+	state := replState{
+		SystemID:    c.identity.SystemID,
+		Timeline:    c.identity.Timeline,
+		Slot:        c.config.Slot,
+		LSN:         uint64(lsn),
+		CopyPending: c.copyPending,
+		Updated:     time.Now(),
+	}
+	return state.save(c.config.StateFile)
+}
@@ -0,0 +1,195 @@
+package pg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+)
+
+const (
+	// streamInsertBatch is the number of changes that are spooled with one INSERT statement
+	streamInsertBatch = 1000
+	// streamReadBatch is the number of changes that are read from the spool at once
+	streamReadBatch = 1000
+)
+
+// streamTable returns the table that buffers changes of streamed in-progress transactions on the destination.
+// Buffering on the destination (instead of in memory) makes sure that chunks which have already been
+// acknowledged to the message bus survive a restart of pgarrow.
+// When a (sub)transaction is committed or aborted, its changes are replaced by a row that is marked done, with the
+// position of the commit or abort as chunk, so that chunks which are delivered again later on are not spooled again.
+func (c *Conn) streamTable() (string, error) {
+	table := identifierNameSql(c.config.StreamTable)
+	if c.streamTableCreated {
+		return table, nil
+	}
+	if err := c.RunSQL(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id bigserial PRIMARY KEY, xid bigint NOT NULL, "+
+		"subxid bigint NOT NULL, change text, chunk pg_lsn, done boolean NOT NULL DEFAULT false)", table)); err != nil {
+		return "", err
+	}
+	c.streamTableCreated = true
+	return table, nil
+}
+
+// spoolStream buffers a chunk of changes of an in-progress source transaction
+func (c *Conn) spoolStream(t Transaction) (err error) {
+	table, err := c.streamTable()
+	if err != nil {
+		return err
+	}
+	finished, err := c.finishedStreams(table, t.Xid)
+	if err != nil {
+		return err
+	} else if lsn, ok := finished[t.Xid]; ok && pglogrepl.LSN(t.LSN) < lsn {
+		log.Infof("skipping chunk of streamed transaction (xid %d, lsn %s), which is already finished", t.Xid,
+			pglogrepl.LSN(t.LSN))
+		return nil
+	}
+	var stmts []string
+	if t.FirstSegment {
+		// After a restart of the producer, in-progress transactions are streamed again from the first segment
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM %s WHERE xid = %d", table, t.Xid))
+	} else {
+		// After a restart of the reader, the chunk could be delivered again
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM %s WHERE xid = %d AND chunk = '%s'", table, t.Xid,
+			pglogrepl.LSN(t.LSN)))
+	}
+	var changes Transactions
+	for _, change := range t.Changes {
+		// skip changes of subtransactions that were aborted since
+		if lsn, ok := finished[change.Xid]; !ok || pglogrepl.LSN(t.LSN) >= lsn {
+			changes = append(changes, change)
+		}
+	}
+	var values []string
+	for i, change := range changes {
+		raw, dErr := change.Dump()
+		if dErr != nil {
+			return dErr
+		}
+		values = append(values, fmt.Sprintf("(%d, %d, %s, '%s')", t.Xid, change.Xid, stringValueSql(string(raw)),
+			pglogrepl.LSN(t.LSN)))
+		if len(values) == streamInsertBatch || i == len(changes)-1 {
+			stmts = append(stmts, fmt.Sprintf("INSERT INTO %s (xid, subxid, change, chunk) VALUES %s",
+				table, strings.Join(values, ", ")))
+			values = nil
+		}
+	}
+	log.Debugf("spooling %d changes for streamed transaction (xid %d)", len(changes), t.Xid)
+	return c.RunTransaction(stmts)
+}
+
+// finishedStreams returns the position of the commit or abort of every finished (sub)transaction of a streamed
+// transaction. The stream is finished for chunks before that position only, since xids could be reused later on.
+func (c *Conn) finishedStreams(table string, xid uint32) (map[uint32]pglogrepl.LSN, error) {
+	rows, err := c.GetRows(fmt.Sprintf("SELECT subxid, chunk FROM %s WHERE xid = %d AND done", table, xid))
+	if err != nil {
+		return nil, err
+	}
+	finished := make(map[uint32]pglogrepl.LSN)
+	for _, row := range rows {
+		subXid, pErr := strconv.ParseUint(row["subxid"], 10, 32)
+		if pErr != nil {
+			return nil, pErr
+		}
+		if finished[uint32(subXid)], pErr = pglogrepl.ParseLSN(row["chunk"]); pErr != nil {
+			return nil, pErr
+		}
+	}
+	return finished, nil
+}
+
+// finishStreamSql returns the statement that marks a streamed (sub)transaction as finished (see streamTable)
+func finishStreamSql(table string, t Transaction, subXid uint32) string {
+	return fmt.Sprintf("INSERT INTO %s (xid, subxid, chunk, done) VALUES (%d, %d, '%s', true)", table, t.Xid, subXid,
+		pglogrepl.LSN(t.LSN))
+}
+
+// commitStream applies all buffered changes of a streamed transaction in one destination transaction,
+// which is ended with end (COMMIT, or PREPARE TRANSACTION for STREAM PREPARE)
+func (c *Conn) commitStream(t Transaction, end string) (err error) {
+	table, err := c.streamTable()
+	if err != nil {
+		return err
+	}
+	var progress string
+	if end == "COMMIT" {
+		// a prepared transaction would lock the progress until COMMIT PREPARED, so the progress is only kept on commit
+		if progress, err = c.progressSql(t); err != nil {
+			return err
+		}
+	}
+	if t.Type == "STREAM PREPARE" {
+		if prepared, pErr := c.isPrepared(t.GID); pErr != nil {
+			return pErr
+		} else if prepared {
+			log.Infof("transaction %s is already prepared, skipping", t.GID)
+			return nil
+		}
+	}
+	return c.transaction(func() error {
+		var lastID int64
+		for {
+			// The spool is read with the query connection, since the replication connection runs the transaction
+			rows, qErr := c.GetRows(fmt.Sprintf("SELECT id, change FROM %s WHERE xid = %d AND NOT done AND id > %d "+
+				"ORDER BY id LIMIT %d", table, t.Xid, lastID, streamReadBatch))
+			if qErr != nil {
+				return qErr
+			}
+			for _, row := range rows {
+				change, cErr := TransactionFromBytes([]byte(row["change"]))
+				if cErr != nil {
+					return cErr
+				}
+				if change.SourceID == "" {
+					change.SourceID = t.SourceID
+				}
+				steps, sErr := c.steps(change)
+				if sErr != nil {
+					return sErr
+				}
+				if err = c.runSteps(steps, t); err != nil {
+					return err
+				}
+				if lastID, err = strconv.ParseInt(row["id"], 10, 64); err != nil {
+					return err
+				}
+			}
+			if len(rows) < streamReadBatch {
+				break
+			}
+		}
+		log.Debugf("applied streamed transaction (xid %d)", t.Xid)
+		if progress != "" {
+			if err = c.exec(progress); err != nil {
+				return err
+			}
+		}
+		if err = c.exec(fmt.Sprintf("DELETE FROM %s WHERE xid = %d", table, t.Xid)); err != nil {
+			return err
+		}
+		return c.exec(finishStreamSql(table, t, t.Xid))
+	}, end)
+}
+
+// abortStream discards the buffered changes of an aborted streamed (sub)transaction
+func (c *Conn) abortStream(t Transaction) (err error) {
+	table, err := c.streamTable()
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("DELETE FROM %s WHERE xid = %d", table, t.Xid)
+	subXid := t.Xid
+	if t.SubXid != 0 && t.SubXid != t.Xid {
+		sql = fmt.Sprintf("%s AND subxid = %d", sql, t.SubXid)
+		subXid = t.SubXid
+	}
+	progress, err := c.progressSql(t)
+	if err != nil {
+		return err
+	}
+	log.Debugf("discarding streamed transaction (xid %d, subxid %d)", t.Xid, t.SubXid)
+	return c.RunTransaction([]string{sql, finishStreamSql(table, t, subXid), progress})
+}
@@ -0,0 +1,66 @@
+package pg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// unchanged returns the names of the columns with an unchanged TOAST value
+func (cvs Columns) unchanged() (names []string) {
+	for name, col := range cvs {
+		if !col.Data.Changed() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// fetchToast replaces unchanged TOAST values of the new row of an UPDATE with the current value on the source.
+// Note that the current value could be newer than the value at the time of the UPDATE.
+// When the row cannot be found (e.a. because it is deleted since), the values stay marked as unchanged.
+func (c *Conn) fetchToast(rel *pglogrepl.RelationMessage, newVals Columns) error {
+	names := newVals.unchanged()
+	if len(names) == 0 {
+		return nil
+	}
+	key := WhereFromLogMsg(rel, nil, newVals)
+	if rel.ReplicaIdentity == 'f' {
+		// all columns of the new row, except the unchanged ones
+		key = WhereFromLogMsg(rel, newVals, nil)
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	var selects []string
+	for _, name := range names {
+		selects = append(selects, fmt.Sprintf("%s::text", identifierNameSql(name)))
+	}
+	table := Table{Namespace: rel.Namespace, TableName: rel.RelationName}
+	query := fmt.Sprintf("SELECT %s FROM ONLY %s WHERE %s", strings.Join(selects, ", "), table.RelationName(),
+		key.WhereSQL(rel.ReplicaIdentity == 'f'))
+	if err := c.qryConnect(); err != nil {
+		return err
+	}
+	log.Debugf("Running SQL: %s", query)
+	results, err := c.qConn.Exec(ctx, query).ReadAll()
+	if err != nil {
+		return err
+	} else if len(results) != 1 || results[0].Err != nil {
+		return fmt.Errorf("could not fetch unchanged TOAST values for %s", table.RelationName())
+	} else if len(results[0].Rows) == 0 {
+		log.Warnf("could not fetch unchanged TOAST values for %s (row not found)", table.RelationName())
+		return nil
+	}
+	for i, name := range names {
+		col := newVals[name]
+		if value := results[0].Rows[0][i]; value == nil {
+			col.Data = Data{Type: 'n'}
+		} else {
+			col.Data = Data{Type: 't', Length: uint32(len(value)), Data: append([]byte(nil), value...)}
+		}
+		newVals[name] = col
+	}
+	return nil
+}
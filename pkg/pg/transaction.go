@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
 var (
@@ -13,6 +14,21 @@ var (
 		"DELETE":   false,
 		"TRUNCATE": true,
 	}
+	// EnvelopeTypes are the transaction types that relate to a source transaction as a whole.
+	// The value defines if the envelope can hold changes.
+	EnvelopeTypes = map[string]bool{
+		"COMMIT":            true,
+		"STREAM":            true,
+		"STREAM COMMIT":     false,
+		"STREAM ABORT":      false,
+		"STREAM PREPARE":    false,
+		"PREPARE":           true,
+		"COMMIT PREPARED":   false,
+		"ROLLBACK PREPARED": false,
+		"COPY":              true,
+		"COPY DONE":         false,
+		"COPY END":          false,
+	}
 )
 
 type Transactions []Transaction
@@ -20,12 +36,42 @@ type Transactions []Transaction
 // Transaction is a wrapper for all info related to a DML
 // pgarrow... creates a Transaction, converts it to JSON and publishes it
 // ...arrowpg reads it, converts from JSON to Transaction and applies it on the dest database
+// A Transaction of an envelope type (e.a. COMMIT) holds all changes of one source transaction in Changes,
+// together with the xid, commit LSN and commit timestamp of that source transaction.
+// A MESSAGE Transaction holds a logical decoding message. Transactional messages are part of the changes of a
+// COMMIT or STREAM envelope, non-transactional messages are published on their own.
+// A DDL Transaction holds a DDL statement as captured on the source, and is part of the changes of an envelope.
+// A RELATION Transaction holds the column metadata of a table, and precedes the first change of that table.
+// A STREAM Transaction holds one chunk of changes of a large in-progress source transaction. Changes in a chunk
+// have the xid of the (sub)transaction they belong to. Chunks are buffered on the destination until a STREAM COMMIT
+// or STREAM ABORT for the same xid is received.
+// With two-phase decoding, a PREPARE Transaction holds all changes of a prepared source transaction, which is
+// prepared with the same GID on the destination. COMMIT PREPARED and ROLLBACK PREPARED (for the same GID) follow later.
+// Envelopes of source transactions that were applied by a replication origin have the name of that origin as Origin.
+// Envelopes are stamped with the source_id of the producer as SourceID.
+// COPY Transactions hold a batch of rows (as INSERT changes) of the initial copy of a table, numbered from 1 per table
+// in Batch. A COPY DONE marks the end of the copy of one table, and COPY END marks the end of the initial copy as a whole.
 type Transaction struct {
-	LSN    uint64
-	Type   string
-	Tables Tables
-	Values Columns
-	Where  Columns
+	LSN          uint64
+	Xid          uint32
+	SubXid       uint32
+	CommitLSN    uint64
+	EndLSN       uint64
+	CommitTime   time.Time
+	FirstSegment bool
+	Batch        int
+	GID          string
+	Origin       string
+	SourceID     string
+	Type         string
+	Tables       Tables
+	Values       Columns
+	Where        Columns
+	FullIdentity bool
+	Changes      Transactions
+	Message      *LogicalMessage
+	DDL          *DDLCommand
+	Relation     *Relation
 }
 
 func (t Transaction) Dump() ([]byte, error) {
@@ -45,7 +91,47 @@ func TransactionFromBytes(j []byte) (t Transaction, err error) {
 	return t, nil
 }
 
+// IsEnvelope returns true if this transaction relates to a source transaction as a whole
+func (t Transaction) IsEnvelope() bool {
+	_, ok := EnvelopeTypes[t.Type]
+	return ok
+}
+
 func (t Transaction) Validate() bool {
+	if t.IsEnvelope() {
+		if !EnvelopeTypes[t.Type] && len(t.Changes) > 0 {
+			log.Debugf("transaction type %s cannot hold changes", t.Type)
+			return false
+		}
+		for _, change := range t.Changes {
+			if change.IsEnvelope() {
+				log.Debugf("transaction type %s cannot be nested", change.Type)
+				return false
+			} else if !change.Validate() {
+				return false
+			}
+		}
+		return true
+	}
+	if t.Type == "MESSAGE" {
+		if t.Message == nil {
+			log.Debugln("message needs to be set")
+			return false
+		}
+		return true
+	} else if t.Type == "DDL" {
+		if t.DDL == nil {
+			log.Debugln("ddl needs to be set")
+			return false
+		}
+		return true
+	} else if t.Type == "RELATION" {
+		if t.Relation == nil || len(t.Tables) != 1 {
+			log.Debugln("relation and table need to be set")
+			return false
+		}
+		return true
+	}
 	if multipleTables, ok := ValidTypes[t.Type]; !ok {
 		log.Debugf("invalid transaction type %s", t.Type)
 		return false
@@ -59,6 +145,20 @@ func (t Transaction) Validate() bool {
 	return true
 }
 
+// Statements returns all statements that need to run (in one destination transaction) to apply this transaction
+func (t Transaction) Statements() (stmts []string) {
+	if !t.IsEnvelope() {
+		if sql := t.Sql(); sql != "" {
+			stmts = append(stmts, sql)
+		}
+		return stmts
+	}
+	for _, change := range t.Changes {
+		stmts = append(stmts, change.Statements()...)
+	}
+	return stmts
+}
+
 func (t Transaction) Sql() string {
 	var sql string
 	if !t.Validate() {
@@ -74,14 +174,29 @@ func (t Transaction) Sql() string {
 	case "TRUNCATE":
 		sql = fmt.Sprintf("TRUNCATE TABLE ONLY %s", t.Tables.RelationNames())
 	case "DELETE":
-		sql = fmt.Sprintf("DELETE FROM %s WHERE %s", t.Tables[0].RelationName(), t.Where.WhereSQL())
+		sql = fmt.Sprintf("DELETE FROM %s WHERE %s", t.Tables[0].RelationName(), t.Where.WhereSQL(t.FullIdentity))
 	case "UPDATE":
 		sql = fmt.Sprintf("UPDATE %s SET %s WHERE %s",
 			t.Tables[0].RelationName(),
 			t.Values.SetSQL(),
-			t.Where.WhereSQL())
+			t.Where.WhereSQL(t.FullIdentity))
+	case "COMMIT", "STREAM", "PREPARE", "COPY":
+		sql = strings.Join(t.Statements(), "; ")
+	case "STREAM COMMIT", "STREAM ABORT", "STREAM PREPARE", "COMMIT PREPARED", "ROLLBACK PREPARED", "MESSAGE",
+		"COPY DONE", "COPY END", "DDL", "RELATION":
 	default:
 		log.Errorf("received unknown transaction type (%s)", t.Type)
 	}
 	return sql
 }
+
+// DDLChanges returns all DDL changes of this transaction
+func (t Transaction) DDLChanges() (ddl Transactions) {
+	if t.Type == "DDL" {
+		return Transactions{t}
+	}
+	for _, change := range t.Changes {
+		ddl = append(ddl, change.DDLChanges()...)
+	}
+	return ddl
+}
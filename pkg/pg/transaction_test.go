@@ -0,0 +1,40 @@
+package pg
+
+import (
+	"testing"
+)
+
+func TestTransactionValidate(t *testing.T) {
+	table := Tables{{Namespace: "public", TableName: "a"}}
+	tables := Tables{{Namespace: "public", TableName: "a"}, {Namespace: "public", TableName: "b"}}
+	insert := Transaction{Type: "INSERT", Tables: table}
+	for _, test := range []struct {
+		name  string
+		t     Transaction
+		valid bool
+	}{
+		{"insert", insert, true},
+		{"invalid type", Transaction{Type: "UPSERT", Tables: table}, false},
+		{"without table", Transaction{Type: "DELETE"}, false},
+		{"update with multiple tables", Transaction{Type: "UPDATE", Tables: tables}, false},
+		{"truncate with multiple tables", Transaction{Type: "TRUNCATE", Tables: tables}, true},
+		{"commit", Transaction{Type: "COMMIT", Changes: Transactions{insert}}, true},
+		{"empty commit", Transaction{Type: "COMMIT"}, true},
+		{"commit with invalid change", Transaction{Type: "COMMIT", Changes: Transactions{{Type: "INSERT"}}}, false},
+		{"nested commit", Transaction{Type: "COMMIT", Changes: Transactions{{Type: "COMMIT"}}}, false},
+		{"stream commit with changes", Transaction{Type: "STREAM COMMIT", Changes: Transactions{insert}}, false},
+		{"copy", Transaction{Type: "COPY", Tables: table, Batch: 1, Changes: Transactions{insert}}, true},
+		{"copy end", Transaction{Type: "COPY END"}, true},
+		{"message", Transaction{Type: "MESSAGE", Message: &LogicalMessage{}}, true},
+		{"message without message", Transaction{Type: "MESSAGE"}, false},
+		{"ddl", Transaction{Type: "DDL", DDL: &DDLCommand{}}, true},
+		{"ddl without command", Transaction{Type: "DDL"}, false},
+		{"relation", Transaction{Type: "RELATION", Tables: table, Relation: &Relation{}}, true},
+		{"relation without table", Transaction{Type: "RELATION", Relation: &Relation{}}, false},
+		{"relation without relation", Transaction{Type: "RELATION", Tables: table}, false},
+	} {
+		if valid := test.t.Validate(); valid != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package pg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// pglogrepl does not (yet) decode the two-phase commit messages of pgoutput protocol version 3,
+// so they are decoded here.
+const (
+	MessageTypeBeginPrepare     pglogrepl.MessageType = 'b'
+	MessageTypePrepare          pglogrepl.MessageType = 'P'
+	MessageTypeCommitPrepared   pglogrepl.MessageType = 'K'
+	MessageTypeRollbackPrepared pglogrepl.MessageType = 'r'
+	MessageTypeStreamPrepare    pglogrepl.MessageType = 'p'
+)
+
+// PrepareMessage is a BEGIN PREPARE, PREPARE, COMMIT PREPARED or STREAM PREPARE message.
+// LSN is the prepare LSN (or the commit LSN for COMMIT PREPARED) and Time the prepare (or commit) timestamp.
+type PrepareMessage struct {
+	msgType pglogrepl.MessageType
+	LSN     pglogrepl.LSN
+	EndLSN  pglogrepl.LSN
+	Time    time.Time
+	Xid     uint32
+	GID     string
+}
+
+func (m *PrepareMessage) Type() pglogrepl.MessageType {
+	return m.msgType
+}
+
+// RollbackPreparedMessage is a ROLLBACK PREPARED message.
+type RollbackPreparedMessage struct {
+	PrepareEndLSN  pglogrepl.LSN
+	RollbackEndLSN pglogrepl.LSN
+	PrepareTime    time.Time
+	RollbackTime   time.Time
+	Xid            uint32
+	GID            string
+}
+
+func (m *RollbackPreparedMessage) Type() pglogrepl.MessageType {
+	return MessageTypeRollbackPrepared
+}
+
+// twoPhaseReader decodes the fields of a two-phase message
+type twoPhaseReader struct {
+	src []byte
+	err error
+}
+
+func (r *twoPhaseReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	} else if len(r.src) < n {
+		r.err = fmt.Errorf("two-phase message too short")
+		return make([]byte, n)
+	}
+	field := r.src[:n]
+	r.src = r.src[n:]
+	return field
+}
+
+func (r *twoPhaseReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *twoPhaseReader) lsn() pglogrepl.LSN {
+	return pglogrepl.LSN(binary.BigEndian.Uint64(r.next(8)))
+}
+
+func (r *twoPhaseReader) time() time.Time {
+	// timestamps are microseconds since 2000-01-01
+	microSecs := int64(binary.BigEndian.Uint64(r.next(8)))
+	return time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(microSecs) * time.Microsecond)
+}
+
+func (r *twoPhaseReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(r.src, 0)
+	if end < 0 {
+		r.err = fmt.Errorf("two-phase message has unterminated string")
+		return ""
+	}
+	s := string(r.src[:end])
+	r.src = r.src[end+1:]
+	return s
+}
+
+// parseTwoPhase decodes a two-phase message, and returns nil (without error) for all other messages
+func parseTwoPhase(data []byte) (pglogrepl.Message, error) {
+	msgType := pglogrepl.MessageType(data[0])
+	r := &twoPhaseReader{src: data[1:]}
+	switch msgType {
+	case MessageTypeBeginPrepare:
+		m := &PrepareMessage{msgType: msgType, LSN: r.lsn(), EndLSN: r.lsn(), Time: r.time(), Xid: r.uint32()}
+		m.GID = r.string()
+		return m, r.err
+	case MessageTypePrepare, MessageTypeCommitPrepared, MessageTypeStreamPrepare:
+		r.next(1) // flags (currently unused)
+		m := &PrepareMessage{msgType: msgType, LSN: r.lsn(), EndLSN: r.lsn(), Time: r.time(), Xid: r.uint32()}
+		m.GID = r.string()
+		return m, r.err
+	case MessageTypeRollbackPrepared:
+		r.next(1) // flags (currently unused)
+		m := &RollbackPreparedMessage{PrepareEndLSN: r.lsn(), RollbackEndLSN: r.lsn(), PrepareTime: r.time(),
+			RollbackTime: r.time(), Xid: r.uint32()}
+		m.GID = r.string()
+		return m, r.err
+	}
+	return nil, nil
+}
+
+// isPrepared checks if a transaction with this gid is prepared on the destination
+func (c *Conn) isPrepared(gid string) (bool, error) {
+	rows, err := c.GetRows(fmt.Sprintf("SELECT gid FROM pg_prepared_xacts WHERE gid = %s", stringValueSql(gid)))
+	if err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// prepareTransaction applies all changes of a PREPARE envelope, and prepares (instead of commits) the
+// destination transaction with the same gid
+func (c *Conn) prepareTransaction(t Transaction) (err error) {
+	if prepared, pErr := c.isPrepared(t.GID); pErr != nil {
+		return pErr
+	} else if prepared {
+		log.Infof("transaction %s is already prepared, skipping", t.GID)
+		return nil
+	}
+	steps, err := c.steps(t)
+	if err != nil {
+		return err
+	}
+	return c.transaction(func() error {
+		return c.runSteps(steps, t)
+	}, prepareSQL(t.GID))
+}
+
+// finishPrepared runs COMMIT PREPARED or ROLLBACK PREPARED for a transaction that was prepared before
+func (c *Conn) finishPrepared(t Transaction, command string) (err error) {
+	if prepared, pErr := c.isPrepared(t.GID); pErr != nil {
+		return pErr
+	} else if !prepared {
+		log.Infof("transaction %s is not prepared (anymore), skipping %s", t.GID, command)
+		return nil
+	}
+	return c.RunSQL(fmt.Sprintf("%s %s", command, stringValueSql(t.GID)))
+}
+
+func prepareSQL(gid string) string {
+	return fmt.Sprintf("PREPARE TRANSACTION %s", stringValueSql(gid))
+}
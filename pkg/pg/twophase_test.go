@@ -0,0 +1,85 @@
+package pg
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// twoPhaseMessage encodes a two-phase message from its fields (uint64 for LSNs and timestamps, uint32 for xids,
+// string for the gid and byte for flags)
+func twoPhaseMessage(msgType pglogrepl.MessageType, fields ...interface{}) []byte {
+	data := []byte{byte(msgType)}
+	for _, field := range fields {
+		switch value := field.(type) {
+		case byte:
+			data = append(data, value)
+		case uint32:
+			data = binary.BigEndian.AppendUint32(data, value)
+		case uint64:
+			data = binary.BigEndian.AppendUint64(data, value)
+		case string:
+			data = append(append(data, value...), 0)
+		}
+	}
+	return data
+}
+
+func TestParseTwoPhase(t *testing.T) {
+	// 2024-01-01 00:00:00 UTC in microseconds since 2000-01-01
+	ts := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	microSecs := uint64(ts.Sub(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)).Microseconds())
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		expected pglogrepl.Message
+		invalid  bool
+	}{
+		{"begin prepare", twoPhaseMessage(MessageTypeBeginPrepare, uint64(100), uint64(200), microSecs,
+			uint32(42), "gid1"), &PrepareMessage{msgType: MessageTypeBeginPrepare, LSN: 100, EndLSN: 200, Time: ts,
+			Xid: 42, GID: "gid1"}, false},
+		{"prepare", twoPhaseMessage(MessageTypePrepare, byte(0), uint64(100), uint64(200), microSecs, uint32(42),
+			"gid1"), &PrepareMessage{msgType: MessageTypePrepare, LSN: 100, EndLSN: 200, Time: ts, Xid: 42,
+			GID: "gid1"}, false},
+		{"commit prepared", twoPhaseMessage(MessageTypeCommitPrepared, byte(0), uint64(300), uint64(400), microSecs,
+			uint32(42), "gid1"), &PrepareMessage{msgType: MessageTypeCommitPrepared, LSN: 300, EndLSN: 400, Time: ts,
+			Xid: 42, GID: "gid1"}, false},
+		{"stream prepare", twoPhaseMessage(MessageTypeStreamPrepare, byte(0), uint64(100), uint64(200), microSecs,
+			uint32(42), "gid1"), &PrepareMessage{msgType: MessageTypeStreamPrepare, LSN: 100, EndLSN: 200, Time: ts,
+			Xid: 42, GID: "gid1"}, false},
+		{"rollback prepared", twoPhaseMessage(MessageTypeRollbackPrepared, byte(0), uint64(200), uint64(500),
+			microSecs, microSecs, uint32(42), "gid1"), &RollbackPreparedMessage{PrepareEndLSN: 200,
+			RollbackEndLSN: 500, PrepareTime: ts, RollbackTime: ts, Xid: 42, GID: "gid1"}, false},
+		{"other message", []byte{'B', 0, 0}, nil, false},
+		{"too short", twoPhaseMessage(MessageTypePrepare, byte(0), uint64(100)), nil, true},
+		{"unterminated gid", append(twoPhaseMessage(MessageTypeBeginPrepare, uint64(100), uint64(200), microSecs,
+			uint32(42)), 'g'), nil, true},
+	} {
+		msg, err := parseTwoPhase(test.data)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		switch expected := test.expected.(type) {
+		case nil:
+			if msg != nil {
+				t.Errorf("%s: expected no message, got %v", test.name, msg)
+			}
+		case *PrepareMessage:
+			if m, ok := msg.(*PrepareMessage); !ok || *m != *expected {
+				t.Errorf("%s: expected %v, got %v", test.name, expected, msg)
+			}
+		case *RollbackPreparedMessage:
+			if m, ok := msg.(*RollbackPreparedMessage); !ok || *m != *expected {
+				t.Errorf("%s: expected %v, got %v", test.name, expected, msg)
+			}
+		}
+	}
+}
@@ -1,12 +1,20 @@
 package rabbitmq
 
 import (
+	"errors"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"net"
 	"time"
 )
 
+// ErrDone can be returned by a PostProcessor to stop Process after the message is acknowledged
+var ErrDone = errors.New("done processing messages")
+
+// ErrUnavailable is returned by Process and ProcessBatch when the queue cannot be created (e.a. the broker is down),
+// in which case processing can be retried with a new connection
+var ErrUnavailable = errors.New("rabbitmq is unavailable")
+
 type Queues map[string]*Queue
 
 type Queue struct {
@@ -41,8 +49,11 @@ func (q *Queue) Connect() (err error) {
 			break
 		}
 	}
-	q.channel, err = q.conn.Channel()
-	return err
+	if q.channel, err = q.conn.Channel(); err != nil {
+		return err
+	}
+	// Publisher confirms are required to know that a message is safely stored in RabbitMQ
+	return q.channel.Confirm(false)
 }
 
 func (q *Queue) MustClose() {
@@ -96,15 +107,27 @@ func (q Queue) Publish(data []byte) (err error) {
 	qCtx, qCtxCancel := q.config.Context()
 	defer qCtxCancel()
 
-	err = q.channel.PublishWithContext(qCtx,
+	deliveryMode := amqp.Persistent
+	if q.config.Transient {
+		deliveryMode = amqp.Transient
+	}
+	var confirmation *amqp.DeferredConfirmation
+	confirmation, err = q.channel.PublishWithDeferredConfirmWithContext(qCtx,
 		"",     // exchange
 		q.name, // routing key
 		false,  // mandatory
 		false,  // immediate
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        data,
+			ContentType:  "application/json",
+			DeliveryMode: deliveryMode,
+			Body:         data,
 		})
+	if err == nil {
+		var acked bool
+		if acked, err = confirmation.WaitContext(qCtx); err == nil && !acked {
+			err = fmt.Errorf("message was not acknowledged by RabbitMQ")
+		}
+	}
 	switch err.(type) {
 	case *amqp.Error:
 		log.Debugf("amqp error: %T: %v", err, err)
@@ -118,7 +141,7 @@ func (q Queue) Publish(data []byte) (err error) {
 
 func (q Queue) Process(PostProcessor func([]byte) error) (err error) {
 	if err = q.CreateQueue(); err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 	var deliveries <-chan amqp.Delivery
 	deliveries, err = q.channel.Consume(
@@ -136,10 +159,78 @@ func (q Queue) Process(PostProcessor func([]byte) error) (err error) {
 
 	for delivery := range deliveries {
 		log.Debugf("received a message of %d bytes", len(delivery.Body))
-		if err = PostProcessor(delivery.Body); err != nil {
+		if err = PostProcessor(delivery.Body); err != nil && !errors.Is(err, ErrDone) {
+			return err
+		}
+		if aErr := delivery.Ack(false); aErr != nil {
+			return aErr
+		}
+		if err != nil {
 			return err
 		}
-		if err = delivery.Ack(false); err != nil {
+	}
+
+	return nil
+}
+
+// ProcessBatch receives up to batchSize messages (waiting at most maxWait after the first message of a batch),
+// processes them with one call of PostProcessor, and acknowledges all of them at once (multiple) when
+// PostProcessor succeeded
+func (q Queue) ProcessBatch(batchSize int, maxWait time.Duration, PostProcessor func([][]byte) error) (err error) {
+	if batchSize <= 1 {
+		return q.Process(func(msg []byte) error {
+			return PostProcessor([][]byte{msg})
+		})
+	}
+	if err = q.CreateQueue(); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	// RabbitMQ needs to deliver a complete batch before any of it is acknowledged
+	if err = q.channel.Qos(batchSize, 0, false); err != nil {
+		return err
+	}
+	var deliveries <-chan amqp.Delivery
+	deliveries, err = q.channel.Consume(
+		q.queue.Name, // queue
+		"",           // consumer
+		false,        // auto-ack
+		false,        // exclusive
+		false,        // no-local
+		false,        // no-wait
+		nil,          // args
+	)
+	if err != nil {
+		return err
+	}
+
+	for delivery := range deliveries {
+		batch := []amqp.Delivery{delivery}
+		timer := time.NewTimer(maxWait)
+	collect:
+		for len(batch) < batchSize {
+			select {
+			case next, ok := <-deliveries:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		var bodies [][]byte
+		for _, d := range batch {
+			bodies = append(bodies, d.Body)
+		}
+		log.Debugf("processing a batch of %d messages", len(batch))
+		if err = PostProcessor(bodies); err != nil && !errors.Is(err, ErrDone) {
+			return err
+		}
+		if aErr := batch[len(batch)-1].Ack(true); aErr != nil {
+			return aErr
+		}
+		if err != nil {
 			return err
 		}
 	}